@@ -44,84 +44,2428 @@ import (
     "github.com/aws/aws-sdk-go/aws/request"
     "github.com/aws/aws-sdk-go/aws"
     "github.com/aws/aws-sdk-go/aws/credentials"
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/service/dynamodb"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
     "fmt"
+    "math"
     "time"
     "sync"
+    "sync/atomic"
+    "net"
     "net/url"
     "net/http"
     "io/ioutil"
     "strings"
+    "strconv"
     "sort"
 )
 
 type AlternatorNodes struct {
     scheme string
     port int
+    // seeds are the nodes given to NewAlternatorNodes(). They are only
+    // used when we don't (yet) have a list of live nodes in 'nodes'.
+    seeds []string
+    next_seed int      // for round-robin load-balancing of 'seeds'
     nodes []string
     next int           // for round-robin load-balancing of 'nodes'
+    // backoff holds, for nodes which asked us to back off with Retry-After,
+    // the time until which we shouldn't send them "/localnodes" requests.
+    backoff map[string]time.Time
+    user_agent string
+    port_candidates []int
+    unix_socket string
+    dial_timeout time.Duration
+    tcp_keepalive time.Duration
+    response_header_timeout time.Duration
+    local_addr net.Addr
+    proxy func(*http.Request) (*url.URL, error)
+    no_proxy []string
+    node_address_mapper func(string) string
+    // The client certificate provider, and the last certificate it
+    // returned, see client_cert.go.
+    client_cert_provider func() (*tls.Certificate, error)
+    client_cert_cache_ttl time.Duration
+    client_cert *tls.Certificate
+    client_cert_time time.Time
+    client_cert_mutex sync.Mutex
+    validate_client_cert bool
+    follow_localnodes_redirects bool
+    // seed_fallback_since is when we started falling back to the seeds,
+    // because we have no list of live nodes. After the threshold, we warn
+    // (once) that we're running in this degraded state.
+    seed_fallback_since time.Time
+    seed_fallback_warned bool
+    seed_fallback_threshold time.Duration
+    seed_fallback_callback func(time.Duration)
+    spread_parallel_scan bool
+    update_retries int
+    update_backoff time.Duration
+    update_deadline time.Duration
+    warm_on_update bool
+    // The transports of the sessions' clients, see warm_connections().
+    data_transports []*http.Transport
+    // See WithNodeSubsetSize().
+    subset_size int
+    client_id string
+    host_header_strategy HostHeaderStrategy
+    scheme_auto_detect bool
+    scheme_checked bool
+    request_signer func(*http.Request) error
+    disable_topology_discovery bool
+    // update_signal wakes up update_thread() for an immediate update. It
+    // has room for one signal, so triggers arriving while an update is in
+    // progress coalesce into a single follow-up update.
+    update_signal chan struct{}
+    describe_endpoints_cache_minutes int64
+    node_equal func(a, b url.URL) bool
+    // When the seeds came from a DNS SRV record, its name, and when we
+    // last looked it up. See NewAlternatorNodesFromSRV().
+    srv_service, srv_proto, srv_name string
+    srv_lookup_time time.Time
+    stride int
+    warn_on_seed_mismatch bool
+    connection_tracing bool
+    tls_session_cache tls.ClientSessionCache
+    // The TLS settings of the "/localnodes" client, see
+    // WithLocalNodesTLSConfig() and WithLocalNodesIgnoreCertError().
+    localnodes_tls_config *tls.Config
+    localnodes_ignore_cert_error bool
+    require_credentials bool
+    // rack and datacenter limit the nodes returned by "/localnodes". They
+    // are protected by the mutex, as they can be changed at any time with
+    // set_rack() and set_datacenter().
+    rack string
+    datacenter string
+    rewrite_log_interval time.Duration
+    // rewrite_logged maps each node to an *atomic.Int64 holding when (in
+    // UnixNano) we last logged a request sent to it.
+    rewrite_logged sync.Map
+    preferred []string
+    next_preferred int  // for round-robin load-balancing of 'preferred'
+    anonymous bool
+    // stats maps each node ("host:port") to its *node_counters, see
+    // node_stats.go.
+    stats sync.Map
+    // Whether an error is the node's fault, see WithRetryableErrorFunc().
+    node_error func(error) bool
+    latency_aware bool
+    disable_seed_fallback bool
+    dns_cache_ttl time.Duration
+    dns_cache *dns_cache
+    retry_different_node bool
+    // The context given to WithContext(), from which ctx is derived.
+    parent_ctx context.Context
+    // The "/localnodes" query parameters for the rack and data center.
+    rack_param string
+    datacenter_param string
+    // See WithStickyControlPlaneNode().
+    sticky_update_node bool
+    last_update_node string
+    // See health_handler().
+    health_min_nodes int
+    health_max_staleness time.Duration
+    // See WithClockSkewDetection().
+    clock_skew_detection bool
+    clock_skew_warned atomic.Bool
+    rate_limit int
+    // See WithPortForScheme().
+    scheme_ports map[string]int
+    initial_cursor uint64
+    preserve_server_order bool
+    allow_empty_node_list bool
+    // The cluster to fail over to, see WithSecondaryNodes().
+    secondary_seeds []string
+    secondary_options []Option
+    secondary *AlternatorNodes
+    close_on_topology_change bool
+    credentials_file string
+    // The known nodes given to NewAlternatorNodesFromURLs() with another
+    // scheme or port than the first one, by node. Not modified after
+    // construction.
+    seed_urls map[string]url.URL
+    // last_good is the last successfully fetched list of nodes, and when it
+    // was fetched. It is replaced (never modified) on every successful
+    // update, so it can be read without locking.
+    last_good atomic.Pointer[fetched_nodes]
+    client_cert_ca *x509.CertPool
+    // client is used for the "/localnodes" requests.
+    client *http.Client
+    // When refresh_only_on_request is set, there is no update thread, and
+    // update_on_request() updates the list of nodes instead. 'updating' and
+    // 'next_update' are only used in this mode.
+    refresh_only_on_request bool
+    updating bool
+    next_update time.Time
+    // See WithMaxTopologyStaleness(). update_done is closed, and replaced,
+    // whenever an update completes, so requests can wait for one.
+    // refresh_failed is when a request last waited for an update which
+    // didn't make the list fresh.
+    max_staleness time.Duration
+    update_done chan struct{}
+    refresh_failed time.Time
+    // ctx is canceled by stop(), or when the WithContext() context is, to
+    // stop the background update thread.
+    ctx context.Context
+    cancel context.CancelFunc
     mutex sync.Mutex
 }
 
-func NewAlternatorNodes(scheme string, port int, nodes []string) *AlternatorNodes {
-    ret := &AlternatorNodes{scheme: scheme, port: port, nodes: nodes}
-    go ret.update_thread()
-    // TODO: how can we stop the background thread if the object is destructed?
+// The version of this library, as reported in the default User-Agent.
+const version = "1.0"
+
+// The default User-Agent we send on "/localnodes" requests, and append to
+// the SDK's User-Agent on data requests, so that requests from balanced
+// clients can be identified in the server's logs.
+const default_user_agent = "alternator-load-balancing-go/" + version
+
+// Option is an optional setting which can be passed to NewAlternatorNodes().
+type Option func(*AlternatorNodes)
+
+// WithUserAgent() replaces the default User-Agent used on "/localnodes"
+// requests, and appended to the SDK's own User-Agent on data requests.
+func WithUserAgent(user_agent string) Option {
+    return func(this *AlternatorNodes) {
+        this.user_agent = user_agent
+    }
+}
+
+// WithPortCandidates() gives a list of ports on which Alternator might be
+// listening, instead of the single port given to NewAlternatorNodes().
+// NewAlternatorNodes() will try the "/localnodes" request on each of these
+// ports, in order, and use the first port on which one of the given nodes
+// responds successfully. If none of them do, the original port is kept (and
+// NewAlternatorNodesE() returns a *ConfigError). Each attempt may take up to
+// a second, so the constructor may block for up to a second per candidate
+// port and seed when they don't respond.
+func WithPortCandidates(ports []int) Option {
+    return func(this *AlternatorNodes) {
+        this.port_candidates = ports
+    }
+}
+
+// WithRefreshOnlyOnRequest() disables the background thread which updates
+// the list of nodes. Instead, the list is updated synchronously, when a
+// request is sent and the previous update is old enough. This is useful
+// in environments where background goroutines are a problem, such as
+// serverless functions which are frozen between invocations. The tradeoff
+// is that while no requests are sent, the list of nodes is not updated,
+// so the first request after a long idle period may use a stale list, and
+// some requests will be delayed by the update.
+func WithRefreshOnlyOnRequest(enabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.refresh_only_on_request = enabled
+    }
+}
+
+// WithUnixSocket() makes all connections - both "/localnodes" requests and
+// data requests - go to the given Unix domain socket, instead of to the
+// node's address over TCP. This is mostly useful for testing, and for a
+// local sidecar. Node selection is unchanged, but as all nodes are reached
+// through the same socket, it no longer spreads the load.
+func WithUnixSocket(path string) Option {
+    return func(this *AlternatorNodes) {
+        this.unix_socket = path
+    }
+}
+
+// The default timeouts for connecting to a node, and interval between TCP
+// keep-alive probes. They are shorter than Go's defaults (30 seconds for
+// both), so that an unreachable node is detected quickly and requests fail
+// over to other nodes.
+const default_dial_timeout = 5*time.Second
+const default_tcp_keepalive = 15*time.Second
+
+// WithDialTimeout() sets the timeout for establishing a connection to a node.
+func WithDialTimeout(timeout time.Duration) Option {
+    return func(this *AlternatorNodes) {
+        this.dial_timeout = timeout
+    }
+}
+
+// WithTCPKeepAlive() sets the interval between TCP keep-alive probes on
+// connections to the nodes. A negative value disables keep-alive probes.
+func WithTCPKeepAlive(interval time.Duration) Option {
+    return func(this *AlternatorNodes) {
+        this.tcp_keepalive = interval
+    }
+}
+
+// WithResponseHeaderTimeout() sets how long to wait for the headers of a
+// node's response after sending it a request. By default there is no such
+// timeout, because legitimate requests (e.g., a large Scan) can be slow.
+func WithResponseHeaderTimeout(timeout time.Duration) Option {
+    return func(this *AlternatorNodes) {
+        this.response_header_timeout = timeout
+    }
+}
+
+// WithLocalAddr() sets the local address from which connections to the
+// nodes - both for "/localnodes" requests and data requests - originate.
+// This is useful on hosts with several network interfaces. The address is
+// usually a *net.TCPAddr with port 0. NewAlternatorNodes() checks that the
+// address can be bound, and prints an error if it can't (and
+// NewAlternatorNodesE() returns a *ConfigError).
+func WithLocalAddr(addr net.Addr) Option {
+    return func(this *AlternatorNodes) {
+        this.local_addr = addr
+    }
+}
+
+// check_local_addr() checks that the address given to WithLocalAddr() is
+// one of this host's addresses, by binding a listening socket to it.
+func (this *AlternatorNodes) check_local_addr() error {
+    addr, ok := this.local_addr.(*net.TCPAddr)
+    if !ok {
+        return fmt.Errorf("local address %v is not a TCP address", this.local_addr)
+    }
+    l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Zone: addr.Zone})
+    if err != nil {
+        return err
+    }
+    return l.Close()
+}
+
+// WithTLSSessionCache() sets a cache of TLS sessions, so new connections to
+// a node can resume a previous TLS session with it instead of doing a full
+// handshake. For example, tls.NewLRUClientSessionCache(0). When it is set,
+// node_stats() also reports how many handshakes were done with each node,
+// and how many of them resumed a session.
+func WithTLSSessionCache(cache tls.ClientSessionCache) Option {
+    return func(this *AlternatorNodes) {
+        this.tls_session_cache = cache
+    }
+}
+
+// WithLocalNodesTLSConfig() sets the TLS configuration of the connections
+// used to fetch the list of nodes, independently of the connections used
+// for requests - e.g., to verify the nodes' certificates against a private
+// CA only on this control path. The configuration is copied. A client
+// certificate from WithClientCertificateProvider() is still presented,
+// unless the configuration has certificates of its own.
+func WithLocalNodesTLSConfig(config *tls.Config) Option {
+    return func(this *AlternatorNodes) {
+        this.localnodes_tls_config = config
+    }
+}
+
+// WithLocalNodesIgnoreCertError() makes the connections used to fetch the
+// list of nodes accept any certificate, e.g., during a migration to new
+// certificates. Requests still verify the certificates as usual.
+func WithLocalNodesIgnoreCertError(ignore bool) Option {
+    return func(this *AlternatorNodes) {
+        this.localnodes_ignore_cert_error = ignore
+    }
+}
+
+// WithProxy() sets the function choosing the HTTP proxy to use for each
+// request, replacing the default of http.ProxyFromEnvironment. It applies
+// both to "/localnodes" requests and to data requests, and is called after
+// we replaced the fake domain by the chosen node, so it sees the real
+// node's address. For an https:// node, the proxy only sees a CONNECT
+// request, and TLS is end-to-end between us and the node. For an https://
+// proxy, the connection to the proxy itself also uses TLS.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) Option {
+    return func(this *AlternatorNodes) {
+        this.proxy = proxy
+    }
+}
+
+// WithNoProxy() gives a list of hosts which should be connected directly,
+// not through the proxy. Each entry is either a host name or IP address
+// which must match exactly, a domain suffix starting with "." (such as
+// ".example.com"), or an IP network in CIDR notation (such as "10.0.0.0/8").
+func WithNoProxy(hosts []string) Option {
+    return func(this *AlternatorNodes) {
+        this.no_proxy = hosts
+    }
+}
+
+// bypass_proxy() checks whether the given host matches the WithNoProxy()
+// list.
+func (this *AlternatorNodes) bypass_proxy(host string) bool {
+    ip := net.ParseIP(host)
+    for _, entry := range this.no_proxy {
+        if _, network, err := net.ParseCIDR(entry); err == nil {
+            if ip != nil && network.Contains(ip) {
+                return true
+            }
+        } else if strings.HasPrefix(entry, ".") {
+            if strings.HasSuffix(host, entry) {
+                return true
+            }
+        } else if host == entry {
+            return true
+        }
+    }
+    return false
+}
+
+// WithNodeAddressMapper() sets a function which translates each node
+// address returned by "/localnodes" to the address this client should use
+// to reach the node. This is needed when the cluster reports internal
+// addresses which aren't reachable from the client (e.g., behind NAT, or
+// from outside a Kubernetes cluster). If the function returns an empty
+// string, the node is dropped. The seeds are not translated.
+func WithNodeAddressMapper(mapper func(string) string) Option {
+    return func(this *AlternatorNodes) {
+        this.node_address_mapper = mapper
+    }
+}
+
+// WithFollowLocalNodesRedirects() allows following HTTP redirects returned
+// for "/localnodes" requests, but only to the same scheme and host. By
+// default, redirects are not followed, and a redirect is reported as an
+// error naming its target - so a reverse proxy can't silently send us to
+// an unexpected host.
+func WithFollowLocalNodesRedirects(enabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.follow_localnodes_redirects = enabled
+    }
+}
+
+// How long we may run on the seeds alone, without managing to fetch the list
+// of live nodes, before warning about it, unless changed with
+// WithSeedFallbackWarning().
+const default_seed_fallback_threshold = 30*time.Second
+
+// WithSeedFallbackWarning() sets how long requests may be sent only to the
+// seeds, because fetching the list of live nodes keeps failing, before we
+// print a warning. If callback isn't nil, it is also called (in a separate
+// goroutine) with the time spent in this state, e.g., to update a metric.
+func WithSeedFallbackWarning(threshold time.Duration, callback func(time.Duration)) Option {
+    return func(this *AlternatorNodes) {
+        this.seed_fallback_threshold = threshold
+        this.seed_fallback_callback = callback
+    }
+}
+
+// WithSpreadParallelScan() makes each segment of a parallel Scan (a Scan
+// request with Segment and TotalSegments set) go to a node determined by
+// its segment number, so the segments are spread over distinct nodes
+// instead of wherever the round-robin happens to be. Other requests, and
+// Scans without segments, use the usual round-robin.
+func WithSpreadParallelScan(enabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.spread_parallel_scan = enabled
+    }
+}
+
+// The default number of retries, and the delay before the first retry, when
+// fetching the list of nodes fails. See WithUpdateRetries().
+const default_update_retries = 2
+const default_update_backoff = 50*time.Millisecond
+
+// WithUpdateRetries() sets how many times to retry fetching the list of
+// nodes - each time from a different node - when it fails, before giving
+// up until the next periodic update. Zero disables the retries.
+func WithUpdateRetries(retries int) Option {
+    return func(this *AlternatorNodes) {
+        this.update_retries = retries
+    }
+}
+
+// WithUpdateBackoff() sets the delay before the first retry of a failed
+// update. The delay doubles for each following retry. Retries which would
+// go beyond the next periodic update are not attempted.
+func WithUpdateBackoff(backoff time.Duration) Option {
+    return func(this *AlternatorNodes) {
+        this.update_backoff = backoff
+    }
+}
+
+// WithUpdateDeadline() bounds the total time one update of the list of nodes
+// may take, including all its retries, by default update_period. When the
+// time is up, even a fetch in progress is abandoned, and we wait for the
+// next periodic update - so a few slow nodes cannot stall the updates.
+func WithUpdateDeadline(deadline time.Duration) Option {
+    return func(this *AlternatorNodes) {
+        this.update_deadline = deadline
+    }
+}
+
+// WithWarmConnectionsOnUpdate() calls warm_connections() in the background
+// whenever an update finds new nodes, including the first update, so the
+// first requests sent to those nodes don't pay for opening a connection.
+func WithWarmConnectionsOnUpdate(warm bool) Option {
+    return func(this *AlternatorNodes) {
+        this.warm_on_update = warm
+    }
+}
+
+// HostHeaderStrategy decides which Host header is sent with data requests,
+// see WithHostHeaderStrategy().
+type HostHeaderStrategy int
+
+const (
+    // HostHeaderFakeDomain sends the fake domain given to session() as the
+    // Host header of every request, whichever node it is sent to. The
+    // request is signed (once) for this fake domain.
+    HostHeaderFakeDomain HostHeaderStrategy = iota
+    // HostHeaderRealNode sends the address of the chosen node as the Host
+    // header. For this, the node is chosen before the request is signed,
+    // and the request is signed for that node.
+    HostHeaderRealNode
+)
+
+// WithHostHeaderStrategy() chooses which Host header is sent with data
+// requests. The default, HostHeaderFakeDomain, works with Alternator
+// itself. HostHeaderRealNode is needed for reverse proxies which route
+// requests according to their Host header.
+func WithHostHeaderStrategy(strategy HostHeaderStrategy) Option {
+    return func(this *AlternatorNodes) {
+        this.host_header_strategy = strategy
+    }
+}
+
+// WithSchemeAutoDetect() helps with a common misconfiguration - using http
+// with a port where Alternator expects https, or vice versa. When enabled,
+// if the first attempt to fetch the list of nodes fails, we check whether
+// the node answers with the other scheme. If it does, we print an error
+// suggesting the correct scheme, and switch to it.
+func WithSchemeAutoDetect(enabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.scheme_auto_detect = enabled
+    }
+}
+
+// WithRequestSigner() sets a function which is called on every request
+// just before it is sent to a node - both "/localnodes" requests and data
+// requests - and can add headers to it, e.g., for a gateway in front of
+// Alternator which requires its own authentication. The function runs
+// after the request was addressed to the chosen node and after it was
+// signed by the SDK, so it must not modify headers covered by the SDK's
+// signature (such as Host or Authorization), or the signature will not
+// match. If it returns an error, the request fails with that error.
+func WithRequestSigner(signer func(*http.Request) error) Option {
+    return func(this *AlternatorNodes) {
+        this.request_signer = signer
+    }
+}
+
+// WithDisableTopologyDiscovery() disables fetching the list of nodes with
+// "/localnodes" altogether: requests are balanced only over the nodes given
+// to NewAlternatorNodes(). This is useful when "/localnodes" isn't reachable
+// from the client, or for testing. Nodes added to or removed from the
+// cluster will not be noticed.
+func WithDisableTopologyDiscovery(disabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.disable_topology_discovery = disabled
+    }
+}
+
+// WithDescribeEndpointsCacheMinutes() replaces the CachePeriodInMinutes in
+// every DescribeEndpoints response with the given value, so an SDK doing
+// endpoint discovery re-resolves the endpoint that often. Zero (the
+// default) leaves the response unchanged.
+//
+// This is not needed for load balancing itself: Alternator answers
+// DescribeEndpoints with the Host header of the request, i.e., the fake
+// domain, so even with endpoint discovery enabled, the requests are still
+// sent to the fake domain, and balanced over all nodes.
+func WithDescribeEndpointsCacheMinutes(minutes int64) Option {
+    return func(this *AlternatorNodes) {
+        this.describe_endpoints_cache_minutes = minutes
+    }
+}
+
+// WithNodeEqualFunc() sets the function deciding whether two node URLs
+// refer to the same node. It is used to drop duplicate nodes from the list
+// returned by "/localnodes", and to decide whether a new list differs from
+// the previous one. The default compares host and port exactly; a custom
+// function is useful when, e.g., with WithNodeAddressMapper(), different
+// addresses reach the same node.
+func WithNodeEqualFunc(equal func(a, b url.URL) bool) Option {
+    return func(this *AlternatorNodes) {
+        this.node_equal = equal
+    }
+}
+
+// WithSelectionStride() makes the round-robin over the live nodes advance by
+// the given number of nodes on each request, instead of by 1, so that
+// consecutive requests go to nodes farther apart in the (sorted) list.
+// To still visit all nodes, if the stride has a common factor with the
+// number of nodes, the next larger stride which doesn't is used.
+func WithSelectionStride(stride int) Option {
+    return func(this *AlternatorNodes) {
+        this.stride = stride
+    }
+}
+
+func gcd(a, b int) int {
+    for b != 0 {
+        a, b = b, a % b
+    }
+    return a
+}
+
+// effective_stride() returns the stride to use with n nodes, see
+// WithSelectionStride().
+func (this *AlternatorNodes) effective_stride(n int) int {
+    stride := this.stride
+    if stride <= 1 || n <= 1 {
+        return 1
+    }
+    for gcd(stride, n) != 1 {
+        stride++
+    }
+    return stride
+}
+
+// WithWarnOnSeedMismatch() makes us print a warning if the first list of
+// nodes fetched from "/localnodes" has no node in common with the seeds.
+// This often means the seeds are on a different network (e.g., a management
+// network) than the addresses the cluster reports, which the client might
+// not be able to reach - so requests will start failing right after the
+// first update. Nodes are compared with WithNodeEqualFunc(), and seeds
+// given as host names are not resolved, so for this check to be useful
+// the seeds should be IP addresses.
+func WithWarnOnSeedMismatch(enabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.warn_on_seed_mismatch = enabled
+    }
+}
+
+// WithRequireCredentials() makes session() and new_session() fail if the
+// key or secret key given to them is empty, instead of failing only when
+// the first request is sent.
+func WithRequireCredentials(required bool) Option {
+    return func(this *AlternatorNodes) {
+        this.require_credentials = required
+    }
+}
+
+// WithAnonymous() makes sessions created by session(), new_session() and
+// augment_session() send unsigned requests, for Alternator clusters which
+// don't enforce authentication. The key and secret key given to session()
+// are then ignored.
+func WithAnonymous() Option {
+    return func(this *AlternatorNodes) {
+        this.anonymous = true
+    }
+}
+
+// WithPreferredNodes() makes requests go only to the given nodes, as long
+// as at least one of them is in the current list of live nodes. Otherwise,
+// requests go to all live nodes as usual. This is a soft preference, e.g.,
+// for steering read traffic to specific nodes during an experiment, not a
+// hard filter.
+func WithPreferredNodes(nodes []string) Option {
+    return func(this *AlternatorNodes) {
+        this.preferred = nodes
+    }
+}
+
+// By default, the message saying which node a request was sent to is
+// logged at most once a minute for each node.
+const default_rewrite_log_interval = 1*time.Minute
+
+// WithRewriteLogInterval() sets how often the message saying which node a
+// request was sent to may be logged for each node. Zero logs every request,
+// which is useful for debugging but very verbose, and a negative interval
+// disables this message.
+func WithRewriteLogInterval(interval time.Duration) Option {
+    return func(this *AlternatorNodes) {
+        this.rewrite_log_interval = interval
+    }
+}
+
+// log_rewrite() logs that a request was sent to the given node, unless
+// this was already logged for this node in the last rewrite_log_interval.
+func (this *AlternatorNodes) log_rewrite(from string, to url.URL) {
+    if this.rewrite_log_interval < 0 {
+        return
+    }
+    if this.rewrite_log_interval > 0 {
+        v, _ := this.rewrite_logged.LoadOrStore(to.Host, new(atomic.Int64))
+        last := v.(*atomic.Int64)
+        now := time.Now().UnixNano()
+        prev := last.Load()
+        if (prev != 0 && now - prev < int64(this.rewrite_log_interval)) || !last.CompareAndSwap(prev, now) {
+            return
+        }
+    }
+    fmt.Printf("Alternator load balacing %s -> %s\n", from, to.String())
+}
+
+// WithRack() limits the requests to nodes in the given rack (e.g., the
+// client's own availability zone), by asking "/localnodes" only for these
+// nodes. The rack is looked up in the data center set with WithDatacenter()
+// or, without it, in the data center of the node answering "/localnodes" -
+// not in all data centers. The rack can later be changed with set_rack().
+func WithRack(rack string) Option {
+    return func(this *AlternatorNodes) {
+        this.rack = rack
+    }
+}
+
+// WithDatacenter() limits the requests to nodes in the given data center.
+// Without it, "/localnodes" returns the nodes in the data center of the
+// node answering it. The data center can later be changed with
+// set_datacenter().
+func WithDatacenter(datacenter string) Option {
+    return func(this *AlternatorNodes) {
+        this.datacenter = datacenter
+    }
+}
+
+// WithLocalNodesRackParam() and WithLocalNodesDCParam() change the names
+// of the "/localnodes" query parameters carrying WithRack() and
+// WithDatacenter(), by default "rack" and "dc", for gateways in front of
+// the cluster which expect other names.
+func WithLocalNodesRackParam(name string) Option {
+    return func(this *AlternatorNodes) {
+        this.rack_param = name
+    }
+}
+
+func WithLocalNodesDCParam(name string) Option {
+    return func(this *AlternatorNodes) {
+        this.datacenter_param = name
+    }
+}
+
+// WithStaticNodes() sets a fixed list of live nodes, and disables fetching
+// the list with "/localnodes" (like WithDisableTopologyDiscovery()). Unlike
+// the nodes given to NewAlternatorNodes(), which are only a fallback until
+// the list of live nodes is known, these nodes are used as the live nodes,
+// with everything that applies to them (e.g., WithPreferredNodes()). This
+// is meant for tests of the node selection, which shouldn't depend on
+// HTTP, and for static deployments.
+func WithStaticNodes(nodes []string) Option {
+    return func(this *AlternatorNodes) {
+        this.nodes = append([]string(nil), nodes...)
+        sort.Strings(this.nodes)
+        this.disable_topology_discovery = true
+    }
+}
+
+func NewAlternatorNodes(scheme string, port int, nodes []string, options ...Option) *AlternatorNodes {
+    ret, _ := new_alternator_nodes(scheme, port, nodes, options, false)
+    return ret
+}
+
+// NewAlternatorNodesE() is like NewAlternatorNodes(), but returns a
+// *ConfigError if an option's value is found invalid when the object is
+// created, instead of just printing the error and carrying on.
+func NewAlternatorNodesE(scheme string, port int, nodes []string, options ...Option) (*AlternatorNodes, error) {
+    return new_alternator_nodes(scheme, port, nodes, options, true)
+}
+
+// new_alternator_nodes() creates the AlternatorNodes object, and starts
+// updating its list of nodes. If strict is set, a configuration error is
+// returned before anything is started. Otherwise it is printed, and the
+// object is created anyway.
+func new_alternator_nodes(scheme string, port int, nodes []string, options []Option, strict bool) (*AlternatorNodes, error) {
+    ret := &AlternatorNodes{scheme: scheme, port: port, seeds: nodes, backoff: map[string]time.Time{},
+        user_agent: default_user_agent, dial_timeout: default_dial_timeout,
+        tcp_keepalive: default_tcp_keepalive, client_cert_cache_ttl: default_client_cert_cache_ttl,
+        seed_fallback_since: time.Now(), seed_fallback_threshold: default_seed_fallback_threshold,
+        update_retries: default_update_retries, update_backoff: default_update_backoff,
+        update_deadline: update_period,
+        rewrite_log_interval: default_rewrite_log_interval, client_id: default_client_id(),
+        rack_param: "rack", datacenter_param: "dc", health_min_nodes: 1,
+        node_error: is_node_error}
+    for _, option := range options {
+        option(ret)
+    }
+    if ret.parent_ctx == nil {
+        ret.parent_ctx = context.Background()
+    }
+    ret.ctx, ret.cancel = context.WithCancel(ret.parent_ctx)
+    if ret.dns_cache_ttl > 0 {
+        ret.dns_cache = new_dns_cache(ret.dns_cache_ttl)
+    }
+    ret.update_signal = make(chan struct{}, 1)
+    ret.update_done = make(chan struct{})
+    if ret.initial_cursor > 0 {
+        // Any offset will do, as update() wraps the cursor around the
+        // length of the list of nodes once it has one.
+        ret.next = int(ret.initial_cursor % math.MaxInt32)
+        if len(ret.nodes) > 0 {
+            ret.next %= len(ret.nodes)
+        }
+        if len(ret.seeds) > 0 {
+            ret.next_seed = int(ret.initial_cursor % uint64(len(ret.seeds)))
+        }
+    }
+    // Before check_config(), which may need it to probe the ports.
+    ret.client = &http.Client{Transport: ret.new_round_tripper(), CheckRedirect: ret.check_redirect}
+    if err := ret.check_config(); err != nil {
+        if strict {
+            ret.cancel()
+            return nil, err
+        }
+        fmt.Println("Alternator configuration ERROR:", err.Error())
+    }
+    if len(ret.secondary_seeds) > 0 {
+        options := append([]Option{WithContext(ret.ctx)}, ret.secondary_options...)
+        secondary, err := new_alternator_nodes(ret.scheme, ret.port, ret.secondary_seeds, options, strict)
+        if err != nil {
+            ret.cancel()
+            return nil, err
+        }
+        ret.secondary = secondary
+    }
+    if !ret.refresh_only_on_request && !ret.disable_topology_discovery {
+        go ret.update_thread()
+    }
+    return ret, nil
+}
+
+// check_config() checks the values of the options which can only be checked
+// when the object is created, and returns a *ConfigError for the first
+// invalid one.
+func (this *AlternatorNodes) check_config() error {
+    if this.local_addr != nil {
+        if err := this.check_local_addr(); err != nil {
+            return &ConfigError{Option: "WithLocalAddr", Err: err}
+        }
+    }
+    if this.validate_client_cert {
+        if err := this.validate_client_certificate(); err != nil {
+            return &ConfigError{Option: "WithValidateClientCert", Err: err}
+        }
+    }
+    if len(this.port_candidates) > 0 {
+        if err := this.probe_port(); err != nil {
+            return &ConfigError{Option: "WithPortCandidates", Err: err}
+        }
+    }
+    return nil
+}
+
+// NewAlternatorNodesFromURLs() is like NewAlternatorNodes(), but takes the
+// known nodes as URLs, such as "https://10.0.0.1:8043", instead of a scheme,
+// a port, and host names. The URLs may use different schemes and ports:
+// each known node is reached with its own URL. The nodes fetched from
+// "/localnodes", which only returns host names, are reached with the scheme
+// and port of the first URL. A URL without a port uses the scheme's default
+// port. An error is returned if a URL has no host, or an unsupported scheme,
+// or if an option is invalid (see NewAlternatorNodesE()).
+func NewAlternatorNodesFromURLs(urls []url.URL, options ...Option) (*AlternatorNodes, error) {
+    if len(urls) == 0 {
+        return nil, errors.New("no node URLs given")
+    }
+    var scheme string
+    var port int
+    nodes := make([]string, len(urls))
+    seed_urls := make(map[string]url.URL)
+    for i, u := range urls {
+        if u.Hostname() == "" {
+            return nil, fmt.Errorf("node URL %q has no host", u.String())
+        }
+        p := u.Port()
+        if p == "" {
+            switch u.Scheme {
+            case "http":
+                p = "80"
+            case "https":
+                p = "443"
+            default:
+                return nil, fmt.Errorf("node URL %q has unsupported scheme", u.String())
+            }
+        }
+        n, err := strconv.Atoi(p)
+        if err != nil {
+            return nil, fmt.Errorf("node URL %q has invalid port: %w", u.String(), err)
+        }
+        if i == 0 {
+            scheme, port = u.Scheme, n
+        }
+        if u.Scheme == scheme && n == port {
+            nodes[i] = u.Hostname()
+        } else {
+            // Named after its URL, so it is distinct from the same host
+            // with the common scheme and port.
+            nodes[i] = u.Scheme + "://" + net.JoinHostPort(u.Hostname(), p)
+            seed_urls[nodes[i]] = url.URL{Scheme: u.Scheme, Host: net.JoinHostPort(u.Hostname(), p)}
+        }
+    }
+    options = append([]Option{func(this *AlternatorNodes) {
+        this.seed_urls = seed_urls
+    }}, options...)
+    return NewAlternatorNodesE(scheme, port, nodes, options...)
+}
+
+// How often the SRV record given to NewAlternatorNodesFromSRV() is looked up
+// again, to update the seeds.
+const srv_refresh_period = 1*time.Minute
+
+// lookup_srv() looks up the given DNS SRV record, and returns its targets
+// and the port they use. As all nodes must use the same port, targets with
+// a different port than the first (highest priority) one are ignored.
+func lookup_srv(service, proto, name string) ([]string, int, error) {
+    _, records, err := net.LookupSRV(service, proto, name)
+    if err != nil {
+        return nil, 0, fmt.Errorf("SRV lookup of %s failed: %w", name, err)
+    }
+    if len(records) == 0 {
+        return nil, 0, fmt.Errorf("SRV lookup of %s returned no records", name)
+    }
+    port := int(records[0].Port)
+    var nodes []string
+    for _, record := range records {
+        if int(record.Port) != port {
+            fmt.Printf("Alternator SRV lookup: ignoring %s:%d, expected port %d\n", record.Target, record.Port, port)
+            continue
+        }
+        nodes = append(nodes, strings.TrimSuffix(record.Target, "."))
+    }
+    return nodes, port, nil
+}
+
+// NewAlternatorNodesFromSRV() is like NewAlternatorNodes(), but takes the
+// known nodes, and their port, from a DNS SRV record - as in service
+// discovery systems such as Consul - instead of from a fixed list. The
+// parameters are the same as for net.LookupSRV(). The record is looked up
+// again periodically, so the known nodes follow changes in DNS. An error
+// is returned if the initial lookup fails or finds no nodes, or if an
+// option is invalid (see NewAlternatorNodesE()).
+func NewAlternatorNodesFromSRV(scheme string, service, proto, name string, options ...Option) (*AlternatorNodes, error) {
+    nodes, port, err := lookup_srv(service, proto, name)
+    if err != nil {
+        return nil, err
+    }
+    options = append([]Option{func(this *AlternatorNodes) {
+        this.srv_service, this.srv_proto, this.srv_name = service, proto, name
+        this.srv_lookup_time = time.Now()
+    }}, options...)
+    return NewAlternatorNodesE(scheme, port, nodes, options...)
+}
+
+// refresh_srv_seeds() looks up the SRV record given to
+// NewAlternatorNodesFromSRV() again, if it's time to, and replaces the
+// seeds with its targets. If the lookup fails, the old seeds are kept.
+func (this *AlternatorNodes) refresh_srv_seeds() {
+    if this.srv_name == "" || time.Since(this.srv_lookup_time) < srv_refresh_period {
+        return
+    }
+    this.srv_lookup_time = time.Now()
+    nodes, port, err := lookup_srv(this.srv_service, this.srv_proto, this.srv_name)
+    if err != nil {
+        fmt.Println(err.Error())
+        return
+    }
+    if port != this.port {
+        fmt.Printf("Alternator SRV lookup: ignoring change of port from %d to %d\n", this.port, port)
+    }
+    this.mutex.Lock()
+    this.seeds = nodes
+    this.next_seed = 0
+    this.mutex.Unlock()
+}
+
+// probe_port() sets 'port' to the first of 'port_candidates' on which one
+// of the seeds responds to a "/localnodes" request. It returns an error,
+// and keeps 'port' unchanged, if there is no such port.
+func (this *AlternatorNodes) probe_port() error {
+    for _, port := range this.port_candidates {
+        for _, seed := range this.seeds {
+            if this.probe(this.scheme, seed, port) {
+                fmt.Printf("Alternator port probe: using port %d\n", port)
+                this.port = port
+                return nil
+            }
+        }
+    }
+    return fmt.Errorf("no seed responded on any of the ports %v, using port %d", this.port_candidates, this.port)
+}
+
+// probe() checks if the given node responds successfully to a "/localnodes"
+// request with the given scheme and port.
+func (this *AlternatorNodes) probe(scheme string, node string, port int) bool {
+    if _, ok := this.seed_urls[node]; ok {
+        // Only reached with its own URL.
+        return false
+    }
+    ctx, cancel := context.WithTimeout(this.ctx, 1*time.Second)
+    defer cancel()
+    url := fmt.Sprintf("%s://%s:%d/localnodes", scheme, node, port)
+    req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+    if err != nil {
+        return false
+    }
+    req.Header.Set("User-Agent", this.user_agent)
+    resp, err := this.client.Do(req)
+    if err != nil {
+        return false
+    }
+    resp.Body.Close()
+    return resp.StatusCode == http.StatusOK
+}
+
+// new_transport() creates the HTTP transport used for connecting to the
+// Alternator nodes. The "/localnodes" requests and the data requests each
+// get their own transport, with its own connection pool.
+func (this *AlternatorNodes) new_transport(data_plane bool) *http.Transport {
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    dialer := &net.Dialer{Timeout: this.dial_timeout, KeepAlive: this.tcp_keepalive, LocalAddr: this.local_addr}
+    transport.DialContext = dialer.DialContext
+    if this.dns_cache != nil {
+        transport.DialContext = this.dns_cache.wrap(transport.DialContext)
+    }
+    if this.unix_socket != "" {
+        path := this.unix_socket
+        // A local TCP address makes no sense for a Unix socket.
+        unix_dialer := &net.Dialer{Timeout: this.dial_timeout}
+        transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+            return unix_dialer.DialContext(ctx, "unix", path)
+        }
+    }
+    if data_plane && this.connection_tracing {
+        transport.DialContext = this.count_connections(transport.DialContext)
+    }
+    transport.ResponseHeaderTimeout = this.response_header_timeout
+    if this.client_cert_provider != nil || this.tls_session_cache != nil {
+        transport.TLSClientConfig = &tls.Config{ClientSessionCache: this.tls_session_cache}
+        if this.client_cert_provider != nil {
+            transport.TLSClientConfig.GetClientCertificate = this.client_certificate
+        }
+    }
+    if !data_plane && this.localnodes_tls_config != nil {
+        transport.TLSClientConfig = this.localnodes_tls_config.Clone()
+        if this.client_cert_provider != nil && len(transport.TLSClientConfig.Certificates) == 0 &&
+                transport.TLSClientConfig.GetClientCertificate == nil {
+            transport.TLSClientConfig.GetClientCertificate = this.client_certificate
+        }
+    }
+    if !data_plane && this.localnodes_ignore_cert_error {
+        if transport.TLSClientConfig == nil {
+            transport.TLSClientConfig = &tls.Config{}
+        }
+        transport.TLSClientConfig.InsecureSkipVerify = true
+    }
+    proxy := transport.Proxy
+    if this.proxy != nil {
+        proxy = this.proxy
+    }
+    if len(this.no_proxy) > 0 && proxy != nil {
+        transport.Proxy = func(req *http.Request) (*url.URL, error) {
+            if this.bypass_proxy(req.URL.Hostname()) {
+                return nil, nil
+            }
+            return proxy(req)
+        }
+    } else {
+        transport.Proxy = proxy
+    }
+    return transport
+}
+
+// check_redirect() is the CheckRedirect policy of the "/localnodes" client,
+// see WithFollowLocalNodesRedirects().
+func (this *AlternatorNodes) check_redirect(req *http.Request, via []*http.Request) error {
+    if !this.follow_localnodes_redirects {
+        return http.ErrUseLastResponse
+    }
+    if req.URL.Scheme != via[0].URL.Scheme || req.URL.Host != via[0].URL.Host {
+        return fmt.Errorf("refusing to follow localnodes redirect from %s to %s", via[0].URL, req.URL)
+    }
+    if len(via) >= 10 {
+        return errors.New("stopped after 10 localnodes redirects")
+    }
+    return nil
+}
+
+// get_scheme() returns the scheme used to reach the nodes. It may change
+// after construction, if WithSchemeAutoDetect() is enabled.
+func (this *AlternatorNodes) get_scheme() string {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    return this.scheme
+}
+
+// check_scheme() is called when fetching the list of nodes from the given
+// node failed, and if this is the first failure before any success, checks
+// whether the node answers with the other scheme. See WithSchemeAutoDetect().
+func (this *AlternatorNodes) check_scheme(node string) {
+    this.mutex.Lock()
+    if this.scheme_checked || len(this.nodes) > 0 {
+        this.mutex.Unlock()
+        return
+    }
+    this.scheme_checked = true
+    scheme := this.scheme
+    this.mutex.Unlock()
+    other := "https"
+    if scheme == "https" {
+        other = "http"
+    }
+    if this.probe(other, node, this.port_for(other)) {
+        fmt.Printf("Alternator ERROR: node %s does not answer %s on port %d, but does answer %s on port %d. Switching to %s - please fix the configured scheme.\n",
+            node, scheme, this.port_for(scheme), other, this.port_for(other), other)
+        this.mutex.Lock()
+        this.scheme = other
+        this.mutex.Unlock()
+    }
+}
+
+// new_round_tripper() returns the http.RoundTripper for the "/localnodes"
+// client: a new transport, wrapped with the WithRequestSigner() function if
+// one was given.
+func (this *AlternatorNodes) new_round_tripper() http.RoundTripper {
+    var ret http.RoundTripper = this.new_transport(false)
+    if this.request_signer != nil {
+        ret = &signing_round_tripper{base: ret, signer: this.request_signer}
+    }
+    return ret
+}
+
+// new_data_transport() returns a new transport for a session's client. It
+// must remain a plain *http.Transport, as the SDK modifies it for some of
+// its settings, e.g., for a custom CA bundle (AWS_CA_BUNDLE), and fails to
+// create the session if it can't. So what the "/localnodes" client does in
+// new_round_tripper() is done by request handlers instead, see
+// install_handlers().
+func (this *AlternatorNodes) new_data_transport() *http.Transport {
+    transport := this.new_transport(true)
+    this.mutex.Lock()
+    this.data_transports = append(this.data_transports, transport)
+    this.mutex.Unlock()
+    return transport
+}
+
+// signing_round_tripper calls a WithRequestSigner() function on each request
+// before passing it to the underlying RoundTripper.
+type signing_round_tripper struct {
+    base http.RoundTripper
+    signer func(*http.Request) error
+}
+
+func (t *signing_round_tripper) RoundTrip(req *http.Request) (*http.Response, error) {
+    // A RoundTripper must not modify the request it was given.
+    req = req.Clone(req.Context())
+    if err := t.signer(req); err != nil {
+        if req.Body != nil {
+            req.Body.Close()
+        }
+        return nil, err
+    }
+    return t.base.RoundTrip(req)
+}
+
+// stop() stops the background thread which updates the list of nodes, and
+// aborts a "/localnodes" request it may have in progress. The
+// AlternatorNodes object can still be used after stop(), but its list of
+// nodes will no longer be updated. It is safe to call stop() more than once.
+func (this *AlternatorNodes) stop() {
+    if this.cancel != nil {
+        this.cancel()
+    }
+}
+
+func (this *AlternatorNodes) pickone() string {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if len(this.nodes) == 0 {
+        return this.pick_seed()
+    }
+    if len(this.preferred) > 0 {
+        if ret, ok := this.pick_preferred(); ok {
+            return ret
+        }
+    }
+    if this.latency_aware {
+        if ret, ok := this.pick_by_latency(); ok {
+            return ret
+        }
+    }
+    ret := this.nodes[this.next]
+    this.next = (this.next + this.effective_stride(len(this.nodes))) % len(this.nodes)
+    return ret
+}
+
+// preview_selection() returns how the next n calls to pickone() would be
+// distributed over the nodes, without actually advancing the rotation.
+// It is useful for checking that the load is spread as intended.
+func (this *AlternatorNodes) preview_selection(n int) map[string]int {
+    // Run the real selection code on a copy of the rotation state.
+    this.mutex.Lock()
+    preview := &AlternatorNodes{
+        seeds: this.seeds,
+        next_seed: this.next_seed,
+        nodes: this.nodes,
+        next: this.next,
+        stride: this.stride,
+        preferred: this.preferred,
+        next_preferred: this.next_preferred,
+        backoff: make(map[string]time.Time, len(this.backoff)),
+        // A preview shouldn't warn about the seed fallback.
+        seed_fallback_warned: true,
+    }
+    for node, until := range this.backoff {
+        preview.backoff[node] = until
+    }
+    this.mutex.Unlock()
+    ret := make(map[string]int)
+    for i := 0; i < n; i++ {
+        ret[preview.pickone()]++
+    }
+    return ret
+}
+
+// current_nodes() returns a copy of the list of nodes which pickone()
+// currently chooses from - the live nodes, or the seeds if we have no live
+// nodes.
+func (this *AlternatorNodes) current_nodes() []string {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if len(this.nodes) == 0 {
+        return append([]string(nil), this.seeds...)
+    }
+    return append([]string(nil), this.nodes...)
+}
+
+// node_url() returns the base URL for sending requests to the given node.
+func (this *AlternatorNodes) node_url(node string) url.URL {
+    if u, ok := this.seed_urls[node]; ok {
+        return u
+    }
+    scheme := this.get_scheme()
+    return url.URL{Scheme: scheme, Host: fmt.Sprintf("%s:%d", node, this.port_for(scheme))}
+}
+
+// for_each_node() calls f on every one of the current nodes, for operations
+// which need to reach all nodes, not just one. The list of nodes is copied
+// first, so concurrent updates of the list don't cause nodes to be skipped
+// or visited twice. f is called on all nodes even if some calls fail, and
+// the errors they returned are returned joined together.
+func (this *AlternatorNodes) for_each_node(f func(url.URL) error) error {
+    var errs []error
+    for _, node := range this.current_nodes() {
+        if err := f(this.node_url(node)); err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", node, err))
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// warm_connections() opens a connection to each of the current nodes, in
+// each session created by this object, so the first requests sent to them
+// don't pay for the connection setup and TLS handshake. The connections
+// are opened with a "GET /" health-check request, and are then kept in the
+// session's pool of idle connections. A node which can't be reached doesn't
+// stop the others from being warmed; the errors are returned joined
+// together.
+func (this *AlternatorNodes) warm_connections(ctx context.Context) error {
+    this.mutex.Lock()
+    transports := append([]*http.Transport(nil), this.data_transports...)
+    this.mutex.Unlock()
+    nodes := this.current_nodes()
+    errs := make([]error, len(nodes))
+    var wg sync.WaitGroup
+    for i, node := range nodes {
+        u := this.node_url(node)
+        wg.Add(1)
+        go func(i int, node string) {
+            defer wg.Done()
+            for _, transport := range transports {
+                if err := warm_connection(ctx, transport, u.String()+"/"); err != nil {
+                    errs[i] = fmt.Errorf("%s: %w", node, err)
+                    return
+                }
+            }
+        }(i, node)
+    }
+    wg.Wait()
+    return errors.Join(errs...)
+}
+
+func warm_connection(ctx context.Context, transport *http.Transport, url string) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := transport.RoundTrip(req)
+    if err != nil {
+        return err
+    }
+    // Read the body to the end, so the connection can be reused.
+    ioutil.ReadAll(resp.Body)
+    resp.Body.Close()
+    return nil
+}
+
+// fetched_nodes is a list of nodes fetched from "/localnodes", and when.
+type fetched_nodes struct {
+    nodes []string
+    time time.Time
+}
+
+// live_nodes_with_age() returns the last successfully fetched list of nodes,
+// and how long ago it was fetched. If fetching has been failing for a while,
+// this shows how stale the list is, so the application can decide how much
+// to trust it. If the list was never fetched, the seeds are returned with
+// an age of -1. Without topology discovery (WithStaticNodes() or
+// WithDisableTopologyDiscovery()), the nodes in use are returned with an
+// age of 0, as they never become stale.
+func (this *AlternatorNodes) live_nodes_with_age() ([]url.URL, time.Duration) {
+    var nodes []string
+    age := time.Duration(-1)
+    if this.disable_topology_discovery {
+        this.mutex.Lock()
+        nodes = this.nodes
+        if len(nodes) == 0 {
+            nodes = this.seeds
+        }
+        this.mutex.Unlock()
+        age = 0
+    } else if last_good := this.last_good.Load(); last_good != nil {
+        nodes, age = last_good.nodes, time.Since(last_good.time)
+    } else {
+        this.mutex.Lock()
+        nodes = this.seeds
+        this.mutex.Unlock()
+    }
+    ret := make([]url.URL, len(nodes))
+    for i, node := range nodes {
+        ret[i] = this.node_url(node)
+    }
+    return ret, age
+}
+
+// is_using_seed_fallback() returns true if we don't have a list of live
+// nodes, so requests are sent only to the seeds. This is normal for a short
+// time after startup, but if it persists, fetching the list of live nodes
+// keeps failing.
+func (this *AlternatorNodes) is_using_seed_fallback() bool {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    return len(this.nodes) == 0
+}
+
+// next_nodes() returns up to n distinct nodes, in round-robin order, for
+// callers which want to send the same request to more than one node (e.g.,
+// to hedge against a slow node). If there are fewer than n nodes, all of
+// them are returned. The rotation is advanced by n, so the next call (or
+// the next requests) continue with the following nodes. Like requests, it
+// falls back to the seeds while there is no list of live nodes - unless
+// WithDisableSeedFallback() forbids it, in which case no nodes are returned.
+func (this *AlternatorNodes) next_nodes(n int) []url.URL {
+    if this.no_nodes() != nil {
+        return nil
+    }
+    this.mutex.Lock()
+    nodes, next := this.nodes, &this.next
+    if len(nodes) == 0 {
+        nodes, next = this.seeds, &this.next_seed
+    }
+    if len(nodes) == 0 {
+        this.mutex.Unlock()
+        return nil
+    }
+    count := n
+    if count > len(nodes) {
+        count = len(nodes)
+    }
+    hosts := make([]string, count)
+    for i := range hosts {
+        hosts[i] = nodes[(*next + i) % len(nodes)]
+    }
+    if n > 0 {
+        *next = (*next + n) % len(nodes)
+    }
+    this.mutex.Unlock()
+    ret := make([]url.URL, count)
+    for i, host := range hosts {
+        ret[i] = this.node_url(host)
+    }
+    return ret
+}
+
+// WithRetryDifferentNode() makes the SDK's retries of a request which failed
+// because of its node (see WithRetryableErrorFunc()) go to a different node,
+// instead of to the same one as the failed attempt. Retries of other
+// errors, such as throttling, still go to the same node.
+func WithRetryDifferentNode(enabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.retry_different_node = enabled
+    }
+}
+
+// failed_node_key is the context key under which the node of a request's
+// last failed attempt is stored, see WithRetryDifferentNode().
+type failed_node_key struct{}
+
+// remember_failed_node() is a Retry handler which, if the attempt failed
+// because of its node, remembers that node in the request's context, so
+// the retry is routed again, to another node.
+func (this *AlternatorNodes) remember_failed_node(r *request.Request) {
+    if r.Error != nil && this.node_error(r.Error) {
+        r.SetContext(context.WithValue(r.Context(), failed_node_key{}, r.HTTPRequest.URL.Host))
+    }
+}
+
+// reroute_retry() returns true if the request is a retry which should be
+// routed again, because its previous attempt failed on the node it is
+// still addressed to.
+func reroute_retry(r *request.Request) bool {
+    failed, ok := r.Context().Value(failed_node_key{}).(string)
+    return ok && failed == r.HTTPRequest.URL.Host
+}
+
+// pick_other() picks a node other than the given failed one ("host:port"),
+// unless it's the only one.
+func (this *AlternatorNodes) pick_other(failed string) string {
+    n := len(this.current_nodes())
+    node := this.pickone()
+    for i := 1; i < n && this.node_url(node).Host == failed; i++ {
+        node = this.pickone()
+    }
+    return node
+}
+
+// WithContext() ties the background thread updating the list of nodes to
+// the given context: when it is canceled, e.g., when the application shuts
+// down, the thread stops as if stop() was called. stop() still works too.
+func WithContext(ctx context.Context) Option {
+    return func(this *AlternatorNodes) {
+        this.parent_ctx = ctx
+    }
+}
+
+// WithSecondaryNodes() sets up a second cluster, e.g., in another region,
+// to which requests fail over when this cluster is down: when its list of
+// nodes couldn't be refreshed for secondary_failover_staleness, and the
+// second cluster's list could. Requests go back to this cluster as soon as
+// its list is refreshed again. The second cluster is reached with the
+// same scheme, port, fake domain and credentials as this one, and has its
+// own list of nodes, updated by its own thread; the given options apply
+// only to it. stop() stops both. active_cluster() says which one is used.
+func WithSecondaryNodes(nodes []string, options ...Option) Option {
+    return func(this *AlternatorNodes) {
+        this.secondary_seeds = nodes
+        this.secondary_options = options
+    }
+}
+
+// How long the list of nodes may go without a successful refresh before
+// requests fail over to the WithSecondaryNodes() cluster.
+const secondary_failover_staleness = 5*update_period
+
+// is_down() returns true if we haven't been able to refresh the list of
+// nodes for secondary_failover_staleness, see WithSecondaryNodes().
+func (this *AlternatorNodes) is_down() bool {
+    if this.disable_topology_discovery {
+        return false
+    }
+    this.mutex.Lock()
+    since := this.seed_fallback_since
+    this.mutex.Unlock()
+    if last_good := this.last_good.Load(); last_good != nil {
+        if len(last_good.nodes) == 0 {
+            return true
+        }
+        since = last_good.time
+    }
+    return time.Since(since) > secondary_failover_staleness
+}
+
+// active() returns the cluster requests should go to: this one, or the
+// WithSecondaryNodes() cluster if this one is down and it isn't.
+func (this *AlternatorNodes) active() *AlternatorNodes {
+    if this.secondary != nil && this.is_down() && !this.secondary.is_down() {
+        return this.secondary
+    }
+    return this
+}
+
+// active_cluster() returns "secondary" if requests currently fail over to
+// the WithSecondaryNodes() cluster, and "primary" otherwise.
+func (this *AlternatorNodes) active_cluster() string {
+    if this.active() != this {
+        return "secondary"
+    }
+    return "primary"
+}
+
+// WithCloseConnectionsOnTopologyChange() closes the idle connections kept
+// open for reuse, when a node disappears from the list of nodes. Otherwise,
+// idle connections to the departed node may stay open until the server
+// closes them, or until the transport's IdleConnTimeout. Go's HTTP transport
+// can only close all of its idle connections, not just those to one node,
+// so connections to the remaining nodes are closed too, and reopened when
+// needed.
+func WithCloseConnectionsOnTopologyChange(enabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.close_on_topology_change = enabled
+    }
+}
+
+// close_idle_connections() closes the idle connections of all transports,
+// see WithCloseConnectionsOnTopologyChange().
+func (this *AlternatorNodes) close_idle_connections() {
+    this.mutex.Lock()
+    transports := append([]*http.Transport(nil), this.data_transports...)
+    this.mutex.Unlock()
+    for _, transport := range transports {
+        transport.CloseIdleConnections()
+    }
+    this.client.CloseIdleConnections()
+}
+
+// nodes_removed() returns true if some of the old nodes are not among the
+// new ones.
+func (this *AlternatorNodes) nodes_removed(old_nodes, new_nodes []string) bool {
+    for _, node := range old_nodes {
+        if !this.contains_node(new_nodes, node) {
+            return true
+        }
+    }
+    return false
+}
+
+// WithAllowEmptyNodeList() makes an empty list of nodes returned by
+// "/localnodes" replace the current list, instead of being ignored as an
+// error. By default, the last non-empty list is kept, in case the empty
+// one was a transient glitch. With this option, a rack or data center
+// which really has no nodes left (see WithRack()) makes requests go to the
+// seeds again - or, with WithDisableSeedFallback(), fail with ErrNoNodes.
+func WithAllowEmptyNodeList(allow bool) Option {
+    return func(this *AlternatorNodes) {
+        this.allow_empty_node_list = allow
+    }
+}
+
+// WithInitialCursor() sets where the round-robin over the nodes starts, by
+// default at the first node. Clients started together - each sending only a
+// few requests - would otherwise all start with the same node. Giving each
+// client a different cursor, e.g., a hash of its host name, spreads their
+// first requests over the nodes.
+func WithInitialCursor(cursor uint64) Option {
+    return func(this *AlternatorNodes) {
+        this.initial_cursor = cursor
+    }
+}
+
+// WithPreserveServerOrder() keeps the nodes in the order "/localnodes"
+// returned them, for servers which order them deliberately, e.g., by
+// proximity. By default the list is sorted, because a server may return it
+// in a different order every time, which would make the round-robin over
+// it uneven. With this option, the server is trusted to keep its order
+// stable between updates.
+func WithPreserveServerOrder(preserve bool) Option {
+    return func(this *AlternatorNodes) {
+        this.preserve_server_order = preserve
+    }
+}
+
+// WithPortForScheme() sets the port to use for each scheme, e.g.,
+// {"http": 8080, "https": 8443}, overriding the port given to
+// NewAlternatorNodes() for these schemes. This matters when the scheme
+// changes at runtime (see WithSchemeAutoDetect()), so the port follows it.
+func WithPortForScheme(ports map[string]int) Option {
+    return func(this *AlternatorNodes) {
+        this.scheme_ports = ports
+    }
+}
+
+// port_for() returns the port used to reach the nodes with the given
+// scheme, see WithPortForScheme().
+func (this *AlternatorNodes) port_for(scheme string) int {
+    if port, ok := this.scheme_ports[scheme]; ok {
+        return port
+    }
+    return this.port
+}
+
+// ErrNoNodes is the error of requests which could not be sent because
+// there is no list of live nodes, and WithDisableSeedFallback() forbids
+// sending them to the seeds instead.
+var ErrNoNodes = errors.New("no live Alternator nodes are known")
+
+// WithDisableSeedFallback() makes requests fail with ErrNoNodes, instead of
+// going to the seeds, while we don't have a list of live nodes - before the
+// first successful update, or if the list came back empty. This is for
+// deployments where the seeds are management addresses, to which sending
+// requests is worse than failing them. The seeds are still used to fetch
+// the list of nodes. It has no effect with WithDisableTopologyDiscovery(),
+// where the seeds are the only nodes.
+func WithDisableSeedFallback(disable bool) Option {
+    return func(this *AlternatorNodes) {
+        this.disable_seed_fallback = disable
+    }
+}
+
+// no_nodes() returns ErrNoNodes if requests can't be sent now, see
+// WithDisableSeedFallback().
+func (this *AlternatorNodes) no_nodes() error {
+    if !this.disable_seed_fallback || this.disable_topology_discovery {
+        return nil
+    }
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if len(this.nodes) == 0 {
+        return ErrNoNodes
+    }
+    return nil
+}
+
+// next_node_e() returns the node to send the next request to, like the
+// requests of a session do, or ErrNoNodes (see WithDisableSeedFallback()).
+// Like a request, it updates the list of nodes first if it is due in
+// WithRefreshOnlyOnRequest() mode, fails over to the WithSecondaryNodes()
+// cluster, and honors WithPerNodeRateLimit().
+func (this *AlternatorNodes) next_node_e() (url.URL, error) {
+    if this.refresh_only_on_request && !this.disable_topology_discovery {
+        this.update_on_request()
+    }
+    this.ensure_fresh(context.Background())
+    nodes := this.active()
+    node, err := nodes.pick_next()
+    if err != nil {
+        return url.URL{}, err
+    }
+    ret := nodes.node_url(node)
+    nodes.counters(ret.Host).selected.Add(1)
+    return ret, nil
+}
+
+// NodeIterator goes over the live nodes in round-robin order, with its own
+// cursor, see node_iterator().
+type NodeIterator struct {
+    nodes *AlternatorNodes
+    mutex sync.Mutex
+    next int
+}
+
+// node_iterator() returns a new NodeIterator, for an application which wants
+// to pull nodes itself, e.g., to feed its own connection pool. Its cursor is
+// independent of the one used by requests (and by next_nodes()), so it
+// neither skips nodes because of requests nor affects their balancing.
+func (this *AlternatorNodes) node_iterator() *NodeIterator {
+    return &NodeIterator{nodes: this}
+}
+
+// Next() returns the next node, or an empty URL if no nodes are known - or
+// if there is no list of live nodes and WithDisableSeedFallback() forbids
+// falling back to the seeds. It follows updates of the list of nodes between
+// calls. It is safe to call from multiple goroutines.
+func (it *NodeIterator) Next() url.URL {
+    if it.nodes.no_nodes() != nil {
+        return url.URL{}
+    }
+    nodes := it.nodes.current_nodes()
+    if len(nodes) == 0 {
+        return url.URL{}
+    }
+    it.mutex.Lock()
+    node := nodes[it.next % len(nodes)]
+    it.next = (it.next + 1) % len(nodes)
+    it.mutex.Unlock()
+    return it.nodes.node_url(node)
+}
+
+// pick_for_request() picks the node to send the given SDK request to.
+func (this *AlternatorNodes) pick_for_request(r *request.Request) (string, error) {
+    if this.spread_parallel_scan {
+        if input, ok := r.Params.(*dynamodb.ScanInput); ok && input.Segment != nil && input.TotalSegments != nil {
+            if err := this.no_nodes(); err != nil {
+                return "", err
+            }
+            return this.pick_segment(*input.Segment), nil
+        }
+    }
+    return this.pick_next()
+}
+
+// pick_next() picks the next node in turn, as pickone() does, but also
+// honoring WithDisableSeedFallback() and WithPerNodeRateLimit().
+func (this *AlternatorNodes) pick_next() (string, error) {
+    if err := this.no_nodes(); err != nil {
+        return "", err
+    }
+    node := this.pickone()
+    if this.rate_limit > 0 {
+        node = this.rate_limit_node(node)
+    }
+    return node, nil
+}
+
+// pick_segment() picks the node for segment number 'segment' of a parallel
+// Scan. Consecutive segments go to consecutive nodes of the current list.
+func (this *AlternatorNodes) pick_segment(segment int64) string {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    nodes := this.nodes
+    if len(nodes) == 0 {
+        nodes = this.seeds
+    }
+    if segment < 0 {
+        segment = -segment
+    }
+    return nodes[segment % int64(len(nodes))]
+}
+
+// pick_preferred() picks, in round-robin order, one of the preferred nodes
+// which are also live nodes. It returns false if there is no such node.
+// Must be called with the mutex held.
+func (this *AlternatorNodes) pick_preferred() (string, bool) {
+    for i := 0; i < len(this.preferred); i++ {
+        node := this.preferred[this.next_preferred]
+        this.next_preferred = (this.next_preferred + 1) % len(this.preferred)
+        for _, live := range this.nodes {
+            if live == node {
+                return node, true
+            }
+        }
+    }
+    return "", false
+}
+
+// pick_seed() is pickone()'s fallback when we have no list of live nodes,
+// either because we didn't manage to fetch one yet, or because all our
+// attempts failed. It goes over the seeds in round-robin order, with its
+// own cursor, skipping seeds which recently asked us to back off (unless
+// all of them did). Must be called with the mutex held.
+func (this *AlternatorNodes) pick_seed() string {
+    now := time.Now()
+    if d := now.Sub(this.seed_fallback_since); d > this.seed_fallback_threshold && !this.seed_fallback_warned && !this.disable_topology_discovery {
+        this.seed_fallback_warned = true
+        fmt.Printf("Alternator WARNING: failed to fetch the list of live nodes for %v, using only the seeds %v\n", d, this.seeds)
+        if this.seed_fallback_callback != nil {
+            go this.seed_fallback_callback(d)
+        }
+    }
+    for i := 0; i < len(this.seeds); i++ {
+        ret := this.seeds[this.next_seed]
+        this.next_seed = (this.next_seed + 1) % len(this.seeds)
+        if until, ok := this.backoff[ret]; !ok || now.After(until) {
+            return ret
+        }
+    }
+    ret := this.seeds[this.next_seed]
+    this.next_seed = (this.next_seed + 1) % len(this.seeds)
     return ret
 }
 
-func (this *AlternatorNodes) pickone() string {
-    this.mutex.Lock()
-    ret := this.nodes[this.next]
-    this.next++
-    if this.next == len(this.nodes) {
-        this.next = 0
+// WithStickyControlPlaneNode() sends each "/localnodes" request to the same
+// node as the previous successful one, instead of going over the nodes in
+// turn, so it can reuse the open connection (and TLS session) to that node.
+// When a request fails, the next one goes to another node as usual.
+func WithStickyControlPlaneNode(sticky bool) Option {
+    return func(this *AlternatorNodes) {
+        this.sticky_update_node = sticky
+    }
+}
+
+// pick_update_node() picks the node to which we send the next "/localnodes"
+// request. Nodes which recently asked us to back off (with a 429 or 503
+// response and a Retry-After header) are skipped until their requested
+// delay has passed, unless all nodes are in this state.
+func (this *AlternatorNodes) pick_update_node() string {
+    if this.sticky_update_node {
+        this.mutex.Lock()
+        node := this.last_update_node
+        this.mutex.Unlock()
+        if node != "" {
+            return node
+        }
     }
+    this.mutex.Lock()
+    n := len(this.nodes)
     this.mutex.Unlock()
+    now := time.Now()
+    ret := this.pickone()
+    for i := 1; i < n; i++ {
+        this.mutex.Lock()
+        until, ok := this.backoff[ret]
+        this.mutex.Unlock()
+        if !ok || now.After(until) {
+            break
+        }
+        ret = this.pickone()
+    }
     return ret
 }
 
-func (this *AlternatorNodes) update_thread() {
-    fmt.Println("livenodes.update() starting with", this.nodes)
-    for {
-        // Contact one of the already known nodes, to fetch a new list of known
-        // nodes.
-        url := fmt.Sprintf("%s://%s:%d/localnodes", this.scheme, this.pickone(), this.port)
-        resp, err := http.Get(url)
+// retry_after_error is returned by fetch_nodes() when the node asked us to
+// come back later (HTTP 429 or 503), and holds the delay it asked for.
+type retry_after_error struct {
+    status int
+    delay time.Duration
+}
+
+func (e *retry_after_error) Error() string {
+    return fmt.Sprintf("localnodes request returned status %d, retry after %v", e.status, e.delay)
+}
+
+// The longest Retry-After we honor, so a misbehaving node can't stop the
+// updates of the list of nodes for hours.
+const max_retry_after = 10*update_period
+
+// parse_retry_after() parses the value of a Retry-After header, which can
+// be either a number of seconds or an HTTP date. It returns 0 if the header
+// is missing or cannot be parsed, and at most max_retry_after.
+func parse_retry_after(value string) time.Duration {
+    if value == "" {
+        return 0
+    }
+    var d time.Duration
+    if secs, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+        if secs > int(max_retry_after / time.Second) {
+            return max_retry_after
+        }
+        d = time.Duration(secs) * time.Second
+    } else if t, err := http.ParseTime(value); err == nil {
+        d = time.Until(t)
+    }
+    if d < 0 {
+        return 0
+    }
+    if d > max_retry_after {
+        return max_retry_after
+    }
+    return d
+}
+
+// localnodes_query() returns the query of "/localnodes" requests asking
+// only for nodes in the rack and data center set with WithRack() and
+// WithDatacenter(), if any.
+func (this *AlternatorNodes) localnodes_query() url.Values {
+    this.mutex.Lock()
+    rack, datacenter := this.rack, this.datacenter
+    this.mutex.Unlock()
+    query := url.Values{}
+    if rack != "" {
+        query.Set(this.rack_param, rack)
+    }
+    if datacenter != "" {
+        query.Set(this.datacenter_param, datacenter)
+    }
+    return query
+}
+
+// localnodes_url() returns the URL of the "/localnodes" request to the given
+// node, with the given query (which may be nil).
+func (this *AlternatorNodes) localnodes_url(node string, query url.Values) string {
+    u := this.node_url(node)
+    u.Path = "/localnodes"
+    u.RawQuery = query.Encode()
+    return u.String()
+}
+
+// empty_nodes_error is returned by fetch_nodes() when the node returned an
+// empty list of nodes.
+type empty_nodes_error struct {
+    node string
+}
+
+func (e *empty_nodes_error) Error() string {
+    return fmt.Sprintf("localnodes request to %s returned no nodes", e.node)
+}
+
+// fetch_nodes() sends a "/localnodes" request to the given node, with the
+// given query (e.g., localnodes_query()), and returns the list of nodes it
+// responded with.
+func (this *AlternatorNodes) fetch_nodes(ctx context.Context, node string, query url.Values) ([]string, error) {
+    url := this.localnodes_url(node, query)
+    req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("User-Agent", this.user_agent)
+    resp, err := this.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    this.check_clock_skew(node, resp)
+    if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+        return nil, &retry_after_error{status: resp.StatusCode, delay: parse_retry_after(resp.Header.Get("Retry-After"))}
+    }
+    if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+        return nil, fmt.Errorf("localnodes request to %s returned status %d redirecting to %q", node, resp.StatusCode, resp.Header.Get("Location"))
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("localnodes request to %s returned status %d", node, resp.StatusCode)
+    }
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    var a []string
+    for _, host := range strings.Split(strings.Trim(string(body),"[]"), ",") {
+        host = strings.Trim(strings.TrimSpace(host), "\"")
+        if host != "" && this.node_address_mapper != nil {
+            host = this.node_address_mapper(host)
+        }
+        if host != "" {
+            a = append(a, host)
+        }
+    }
+    if len(a) == 0 {
+        return nil, &empty_nodes_error{node: node}
+    }
+    var unique []string
+    for _, host := range a {
+        if !this.contains_node(unique, host) {
+            unique = append(unique, host)
+        }
+    }
+    a = unique
+    // sort the list because it can be returned in a different
+    // order every time, making "next" unreliable.
+    if !this.preserve_server_order {
+        sort.Strings(a)
+    }
+    return a, nil
+}
+
+// same_node() checks whether two nodes are the same, see WithNodeEqualFunc().
+func (this *AlternatorNodes) same_node(a, b string) bool {
+    if this.node_equal == nil {
+        return a == b
+    }
+    return this.node_equal(this.node_url(a), this.node_url(b))
+}
+
+// contains_node() checks whether the list contains the given node.
+func (this *AlternatorNodes) contains_node(nodes []string, node string) bool {
+    for _, n := range nodes {
+        if this.same_node(n, node) {
+            return true
+        }
+    }
+    return false
+}
+
+// nodes_changed() checks whether the two lists of nodes differ.
+func (this *AlternatorNodes) nodes_changed(old_nodes, new_nodes []string) bool {
+    if len(old_nodes) != len(new_nodes) {
+        return true
+    }
+    for _, node := range new_nodes {
+        if !this.contains_node(old_nodes, node) {
+            return true
+        }
+    }
+    return false
+}
+
+// check_seed_mismatch() warns if none of the seeds appear in the list of
+// nodes, see WithWarnOnSeedMismatch().
+func (this *AlternatorNodes) check_seed_mismatch(seeds, nodes []string) {
+    for _, seed := range seeds {
+        if this.contains_node(nodes, seed) {
+            return
+        }
+    }
+    fmt.Printf("Alternator WARNING: none of the known nodes %v appear in the list of nodes %v returned by the cluster. "+
+        "If the client can't reach these addresses, all requests will fail.\n", seeds, nodes)
+}
+
+// fetch_all_nodes() fetches the list of nodes from one of the current nodes,
+// and returns it without changing the list of nodes used by this object.
+// It is meant for tools which want to look at the cluster's topology, so
+// it doesn't limit the list to our rack, nor to the data center set with
+// WithDatacenter(). But "/localnodes" without a data center only returns
+// the nodes of the data center of the node answering it, so in a cluster
+// with several data centers, this is just that one data center. The
+// current nodes are tried in turn, until one of them responds.
+func (this *AlternatorNodes) fetch_all_nodes(ctx context.Context) ([]url.URL, error) {
+    var errs []error
+    for _, node := range this.current_nodes() {
+        a, err := this.fetch_nodes(ctx, node, nil)
+        if err != nil {
+            errs = append(errs, err)
+            if ctx.Err() != nil {
+                break
+            }
+            continue
+        }
+        ret := make([]url.URL, len(a))
+        for i, host := range a {
+            ret[i] = this.node_url(host)
+        }
+        return ret, nil
+    }
+    return nil, errors.Join(errs...)
+}
+
+// local_rack_nodes() fetches the live nodes in the rack set with WithRack()
+// (or set_rack()), in the data center set with WithDatacenter() - or
+// without it, in the data center of the node answering - without changing
+// the list of nodes used by this object, e.g., for a tool checking that the
+// client's rack has enough nodes. An empty list, if the rack has no live
+// nodes, is not an error. The current nodes are tried in turn, until one of
+// them responds.
+func (this *AlternatorNodes) local_rack_nodes(ctx context.Context) ([]url.URL, error) {
+    this.mutex.Lock()
+    rack := this.rack
+    this.mutex.Unlock()
+    if rack == "" {
+        return nil, errors.New("no rack was set with WithRack()")
+    }
+    query := this.localnodes_query()
+    var errs []error
+    for _, node := range this.current_nodes() {
+        a, err := this.fetch_nodes(ctx, node, query)
+        var empty *empty_nodes_error
+        if errors.As(err, &empty) {
+            return []url.URL{}, nil
+        }
         if err != nil {
-            fmt.Println(err.Error())
+            errs = append(errs, err)
+            if ctx.Err() != nil {
+                break
+            }
+            continue
+        }
+        ret := make([]url.URL, len(a))
+        for i, host := range a {
+            ret[i] = this.node_url(host)
+        }
+        return ret, nil
+    }
+    return nil, errors.Join(errs...)
+}
+
+// How often we refresh the list of live nodes.
+const update_period = 1*time.Second
+
+// update() contacts one of the already known nodes, to fetch a new list of
+// known nodes. If this fails, it retries a few times, each time with a
+// different node, with exponential backoff between the attempts - but not
+// beyond update_period, when the next update is due anyway. It returns how
+// long to wait before the next update.
+func (this *AlternatorNodes) update() time.Duration {
+    this.refresh_srv_seeds()
+    deadline := time.Now().Add(this.update_deadline)
+    // Derived from this.ctx, so stop() also aborts a fetch in progress.
+    ctx, cancel := context.WithDeadline(this.ctx, deadline)
+    defer cancel()
+    backoff := this.update_backoff
+    sleep := update_period
+    for attempt := 0; ; attempt++ {
+        node := this.pick_update_node()
+        a, err := this.fetch_nodes(ctx, node, this.localnodes_query())
+        if this.ctx.Err() != nil {
+            return sleep
+        }
+        var empty *empty_nodes_error
+        if this.allow_empty_node_list && errors.As(err, &empty) {
+            a, err = nil, nil
+        }
+        if err == nil {
+            // Before subset(), which may well leave the seeds out even when
+            // the cluster does know them.
+            if this.warn_on_seed_mismatch && this.last_good.Load() == nil && len(a) > 0 {
+                this.mutex.Lock()
+                seeds := this.seeds
+                this.mutex.Unlock()
+                this.check_seed_mismatch(seeds, a)
+            }
+            a = this.subset(a)
         } else {
-            defer resp.Body.Close()
-            body, err := ioutil.ReadAll(resp.Body)
-            if err != nil {
-                fmt.Println(err.Error())
-            } else {
-                a := strings.Split(strings.Trim(string(body),"[]"), ",")
-                for i :=  range a {
-                    a[i]  = strings.Trim(a[i], "\"")
+            // Don't stick to a node which failed, see
+            // WithStickyControlPlaneNode().
+            this.mutex.Lock()
+            this.last_update_node = ""
+            this.mutex.Unlock()
+        }
+        if err != nil && ctx.Err() != nil {
+            fmt.Println("livenodes.update() gave up after", this.update_deadline, "-", err.Error())
+            return sleep
+        }
+        if err == nil {
+            this.mutex.Lock()
+            old_nodes := this.nodes
+            this.mutex.Unlock()
+            // nodes_changed() may call node_url(), which takes the mutex.
+            changed := this.nodes_changed(old_nodes, a)
+            this.mutex.Lock()
+            this.nodes = a
+            this.seed_fallback_warned = false
+            if len(this.nodes) > 0 {
+                // If the list shrank, wrap the cursor around the new length,
+                // so the rotation continues evenly over the remaining nodes.
+                this.next %= len(this.nodes)
+            } else if len(old_nodes) > 0 {
+                // With WithAllowEmptyNodeList(), we may go back to using
+                // the seeds.
+                this.next = 0
+                this.seed_fallback_since = time.Now()
+            }
+            delete(this.backoff, node)
+            this.last_update_node = node
+            this.mutex.Unlock()
+            this.last_good.Store(&fetched_nodes{nodes: a, time: time.Now()})
+            if changed {
+                fmt.Println("livenodes.update() updated to ", a)
+                if this.close_on_topology_change && this.nodes_removed(old_nodes, a) {
+                    this.close_idle_connections()
                 }
-                // sort the list because it can be returned in a different
-                // order every time, making "next" unreliable.
-                sort.Strings(a)
-                this.mutex.Lock()
-                this.nodes = a
-                if this.next >= len(this.nodes) {
-                    this.next = 0
+                if this.warm_on_update {
+                    go this.warm_connections(this.ctx)
                 }
-                this.mutex.Unlock()
-                fmt.Println("livenodes.update() updated to ", this.nodes)
             }
+            return update_period
+        }
+        fmt.Println(err.Error())
+        if this.scheme_auto_detect {
+            this.check_scheme(node)
+        }
+        // If the node is overloaded and asked us to come back later,
+        // honor that: don't ask this node again before that time, and
+        // if all attempts fail, delay our next update accordingly.
+        if rerr, ok := err.(*retry_after_error); ok && rerr.delay > 0 {
+            this.mutex.Lock()
+            this.backoff[node] = time.Now().Add(rerr.delay)
+            this.mutex.Unlock()
+            if rerr.delay > sleep {
+                sleep = rerr.delay
+            }
+        }
+        if attempt >= this.update_retries || time.Now().Add(backoff).After(deadline) {
+            return sleep
+        }
+        select {
+        case <-this.ctx.Done():
+            return sleep
+        case <-time.After(backoff):
+        }
+        backoff *= 2
+    }
+}
+
+func (this *AlternatorNodes) update_thread() {
+    fmt.Println("livenodes.update() starting with", this.seeds)
+    for {
+        sleep := this.update()
+        this.finish_update()
+        select {
+        case <-this.ctx.Done():
+            fmt.Println("livenodes.update() stopping")
+            return
+        case <-this.update_signal:
+        case <-time.After(sleep):
         }
-        time.Sleep(1*time.Second)
     }
 }
 
+// set_rack() changes the rack to which requests are limited (see WithRack()),
+// e.g., after the application failed over to another availability zone.
+// An empty rack removes the limit. The list of nodes is updated right away.
+func (this *AlternatorNodes) set_rack(rack string) {
+    this.mutex.Lock()
+    this.rack = rack
+    this.mutex.Unlock()
+    this.trigger_update()
+}
+
+// set_datacenter() changes the data center to which requests are limited
+// (see WithDatacenter()). An empty data center removes the limit. The list
+// of nodes is updated right away.
+func (this *AlternatorNodes) set_datacenter(datacenter string) {
+    this.mutex.Lock()
+    this.datacenter = datacenter
+    this.mutex.Unlock()
+    this.trigger_update()
+}
+
+// trigger_update() asks for the list of nodes to be updated now, instead of
+// waiting for the next periodic update. Only one update runs at a time:
+// if an update is already in progress, any number of trigger_update()
+// calls result in just one more update after it. In WithRefreshOnlyOnRequest()
+// mode, the update is done by the next request.
+func (this *AlternatorNodes) trigger_update() {
+    if this.refresh_only_on_request {
+        this.mutex.Lock()
+        this.next_update = time.Time{}
+        this.mutex.Unlock()
+        return
+    }
+    select {
+    case this.update_signal <- struct{}{}:
+    default:
+    }
+}
+
+// WithMaxTopologyStaleness() guarantees that a request is not balanced by a
+// list of nodes older than the given age: if the last successful update is
+// older, the request asks for an immediate update, and waits for it. The
+// update is still done by the update thread (or, with
+// WithRefreshOnlyOnRequest(), by one of the requests), so there is never
+// more than one "/localnodes" fetch at a time, and concurrent requests wait
+// for the same update. The wait is bounded by about twice
+// WithUpdateDeadline(). If the update fails, the request proceeds with the
+// stale list, and for the next update_period requests don't wait again.
+// Nor do they wait while requests fail over to WithSecondaryNodes(). The
+// default, 0, never delays a request, and relies on the background updates
+// alone.
+func WithMaxTopologyStaleness(d time.Duration) Option {
+    return func(this *AlternatorNodes) {
+        this.max_staleness = d
+    }
+}
+
+// is_stale() returns true if the list of nodes is older than
+// WithMaxTopologyStaleness() allows.
+func (this *AlternatorNodes) is_stale() bool {
+    last_good := this.last_good.Load()
+    return last_good == nil || time.Since(last_good.time) > this.max_staleness
+}
+
+// ensure_fresh() waits for an update of the list of nodes if it is too
+// stale, see WithMaxTopologyStaleness(). ctx is the request's context.
+func (this *AlternatorNodes) ensure_fresh(ctx context.Context) {
+    if this.max_staleness <= 0 || this.disable_topology_discovery || !this.is_stale() {
+        return
+    }
+    if this.secondary != nil && this.active() != this {
+        return
+    }
+    this.mutex.Lock()
+    if time.Since(this.refresh_failed) < update_period {
+        this.mutex.Unlock()
+        return
+    }
+    // An update in progress may have started before the list became too
+    // stale, but it will still replace the list, so waiting for it is
+    // enough.
+    done := this.update_done
+    this.mutex.Unlock()
+    this.trigger_update()
+    if this.refresh_only_on_request {
+        // Does nothing if another request is already updating.
+        this.update_on_request()
+    }
+    timer := time.NewTimer(2*this.update_deadline)
+    defer timer.Stop()
+    select {
+    case <-done:
+    case <-timer.C:
+    case <-ctx.Done():
+        return
+    case <-this.ctx.Done():
+        return
+    }
+    if this.is_stale() {
+        this.mutex.Lock()
+        this.refresh_failed = time.Now()
+        this.mutex.Unlock()
+    }
+}
+
+// finish_update() wakes up the requests waiting in ensure_fresh() for the
+// update which just completed.
+func (this *AlternatorNodes) finish_update() {
+    this.mutex.Lock()
+    close(this.update_done)
+    this.update_done = make(chan struct{})
+    this.mutex.Unlock()
+}
+
+// update_on_request() is used instead of update_thread() when the
+// WithRefreshOnlyOnRequest() option is set. It is called before picking a
+// node for a request, and if the previous update is old enough, it updates
+// the list of nodes synchronously. Concurrent requests do not wait for an
+// update which is already in progress - they use the existing list.
+func (this *AlternatorNodes) update_on_request() {
+    this.mutex.Lock()
+    if this.updating || time.Now().Before(this.next_update) {
+        this.mutex.Unlock()
+        return
+    }
+    this.updating = true
+    this.mutex.Unlock()
+    sleep := this.update()
+    this.finish_update()
+    this.mutex.Lock()
+    this.updating = false
+    this.next_update = time.Now().Add(sleep)
+    this.mutex.Unlock()
+}
+
+// region_key is the context key under which ContextWithRegion() stores the
+// region.
+type region_key struct{}
+
+// ContextWithRegion() returns a context which, when passed to one of the
+// SDK's "WithContext" request functions on a session created by session(),
+// makes that request be signed with the given region instead of the
+// session's region. Alternator itself ignores the region, so this only
+// matters for proxies which route requests by the region in the signature.
+func ContextWithRegion(ctx context.Context, region string) context.Context {
+    return context.WithValue(ctx, region_key{}, region)
+}
+
+// host_key is the context key under which ContextWithHost() stores the
+// Host header.
+type host_key struct{}
+
+// ContextWithHost() returns a context which, when passed to one of the
+// SDK's "WithContext" request functions on a session created by session(),
+// makes that request be sent with the given Host header, instead of the one
+// chosen by WithHostHeaderStrategy(), e.g., for a gateway doing virtual
+// hosting. The signature covers the Host header, so the request is signed
+// for this host, and the server must accept signatures for it.
+func ContextWithHost(ctx context.Context, host string) context.Context {
+    return context.WithValue(ctx, host_key{}, host)
+}
+
+// context_host() returns the Host header set with ContextWithHost() for
+// this request, or "" if none was.
+func context_host(r *request.Request) string {
+    host, _ := r.Context().Value(host_key{}).(string)
+    return host
+}
+
+// SessionError is returned by new_session() when creating the session
+// failed. Step says which step of the setup failed. All these failures are
+// configuration errors - retrying without changing the configuration will
+// not help.
+type SessionError struct {
+    Step string
+    Err error
+}
+
+func (e *SessionError) Error() string {
+    return fmt.Sprintf("alternator session setup failed in %s: %v", e.Step, e.Err)
+}
+
+func (e *SessionError) Unwrap() error {
+    return e.Err
+}
+
+// ConfigError is returned by NewAlternatorNodesE() (and the constructors
+// and builder using it) when the value given to an option is invalid.
+// Option is the name of the option.
+type ConfigError struct {
+    Option string
+    Err error
+}
+
+func (e *ConfigError) Error() string {
+    return fmt.Sprintf("alternator option %s is invalid: %v", e.Option, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+    return e.Err
+}
+
+// NodeError is the error returned by a request which failed, saying which
+// node ("host:port") it was last sent to, so failures can be tied to a
+// node from the logs alone. It implements awserr.RequestFailure by passing
+// on the wrapped error's code, message and status, so existing code doing
+// err.(awserr.Error) keeps working, and errors.As() can extract it.
+type NodeError struct {
+    Node string
+    Err error
+}
+
+func (e *NodeError) Error() string {
+    return fmt.Sprintf("%v (node %s)", e.Err, e.Node)
+}
+
+func (e *NodeError) Unwrap() error {
+    return e.Err
+}
+
+func (e *NodeError) Code() string {
+    if aerr, ok := e.Err.(awserr.Error); ok {
+        return aerr.Code()
+    }
+    return ""
+}
+
+func (e *NodeError) Message() string {
+    if aerr, ok := e.Err.(awserr.Error); ok {
+        return aerr.Message()
+    }
+    return e.Err.Error()
+}
+
+func (e *NodeError) OrigErr() error {
+    if aerr, ok := e.Err.(awserr.Error); ok {
+        return aerr.OrigErr()
+    }
+    return nil
+}
+
+func (e *NodeError) StatusCode() int {
+    if failure, ok := e.Err.(awserr.RequestFailure); ok {
+        return failure.StatusCode()
+    }
+    return 0
+}
+
+func (e *NodeError) RequestID() string {
+    if failure, ok := e.Err.(awserr.RequestFailure); ok {
+        return failure.RequestID()
+    }
+    return ""
+}
+
+// fake_url() returns the endpoint URL for the given fake domain.
+func (this *AlternatorNodes) fake_url(fake_domain string) (string, error) {
+    if fake_domain == "" {
+        return "", &SessionError{Step: "endpoint", Err: errors.New("fake domain must not be empty")}
+    }
+    scheme := this.get_scheme()
+    if scheme != "http" && scheme != "https" {
+        return "", &SessionError{Step: "endpoint", Err: fmt.Errorf("unsupported scheme %q", scheme)}
+    }
+    return fmt.Sprintf("%s://%s:%d", scheme, fake_domain, this.port_for(scheme)), nil
+}
+
+// node_key is the context key under which ContextWithNode() stores the node.
+type node_key struct{}
+
+// ContextWithNode() returns a context which, when passed to one of the SDK's
+// "WithContext" request functions on a session created by session(), makes
+// that request be sent to the given node, instead of to the next node in
+// the rotation.
+func ContextWithNode(ctx context.Context, node url.URL) context.Context {
+    return context.WithValue(ctx, node_key{}, node)
+}
+
+// ping() checks that the data path to the next node works, including
+// authentication, by sending it a cheap authenticated request (ListTables
+// with a limit of 1) on the given session, which must have been created
+// by this object's session() or augment_session(). This checks more than
+// "/localnodes" can, as that request doesn't require authentication.
+func (this *AlternatorNodes) ping(ctx context.Context, sess *session.Session) error {
+    db := dynamodb.New(sess)
+    _, err := db.ListTablesWithContext(ctx, &dynamodb.ListTablesInput{Limit: aws.Int64(1)})
+    return err
+}
+
+// ping_node() is like ping(), but checks the given node.
+func (this *AlternatorNodes) ping_node(ctx context.Context, sess *session.Session, node url.URL) error {
+    return this.ping(ContextWithNode(ctx, node), sess)
+}
+
 // session() creates a session.Session object, replacing the
 // traditional call to "session.Must(session.NewSession(&cfg)".
+// Like session.Must(), it panics if the session can't be created. Use
+// new_session() to get an error instead.
 func (this *AlternatorNodes) session(
             fake_domain string,
             key string,
             secret_key string) *session.Session {
-    fake_url := fmt.Sprintf("%s://%s:%d", this.scheme, fake_domain, this.port)
+    return session.Must(this.new_session(fake_domain, key, secret_key))
+}
+
+// new_session() is like session(), but returns a *SessionError instead of
+// panicking if the session can't be created.
+func (this *AlternatorNodes) new_session(
+            fake_domain string,
+            key string,
+            secret_key string) (*session.Session, error) {
+    fake_url, err := this.fake_url(fake_domain)
+    if err != nil {
+        return nil, err
+    }
+    if this.require_credentials && !this.anonymous && this.credentials_file == "" && (key == "" || secret_key == "") {
+        return nil, &SessionError{Step: "credentials", Err: errors.New("key and secret key are required")}
+    }
     cfg := aws.Config{
         Endpoint: aws.String(fake_url),
         // Region is used in the signature algorithm so prevent request sent
@@ -131,22 +2475,205 @@ func (this *AlternatorNodes) session(
         // The third credential below, the session token, is only used for
         // temporary credentials, and is not supported by Alternator anyway.
         Credentials: credentials.NewStaticCredentials(key, secret_key, ""),
+        HTTPClient: &http.Client{Transport: this.new_data_transport()},
+    }
+    if this.anonymous {
+        cfg.Credentials = credentials.AnonymousCredentials
+    } else if this.credentials_file != "" {
+        cfg.Credentials = this.file_credentials()
+    }
+    sess, err := session.NewSession(&cfg)
+    if err != nil {
+        return nil, &SessionError{Step: "session", Err: err}
+    }
+    this.install_handlers(sess, fake_domain)
+    return sess, nil
+}
+
+// augment_session() is an alternative to session() for applications which
+// already create their own session.Session, e.g., with their own
+// credentials chain, retryer or logging. It returns a copy of that session,
+// with everything else unchanged, which sends its requests to the fake
+// domain and balances them over the Alternator nodes like a session
+// created by session() does. If the given session has no region, the
+// region is set to "whatever", as Alternator ignores it.
+//
+// The session's HTTP client is kept too, with its timeouts, proxy and
+// transport, so the options configuring our own transport (such as
+// WithDialTimeout() or WithTLSSessionCache()) don't apply to it. Only if it
+// uses the SDK's default client, it gets a client configured by these
+// options, like session() does. With WithRequireCredentials(), the
+// session's credentials are retrieved, to check that there are any.
+func (this *AlternatorNodes) augment_session(
+            base *session.Session,
+            fake_domain string) (*session.Session, error) {
+    fake_url, err := this.fake_url(fake_domain)
+    if err != nil {
+        return nil, err
+    }
+    cfg := aws.Config{
+        Endpoint: aws.String(fake_url),
+    }
+    if client := base.Config.HTTPClient; client == nil || client == http.DefaultClient {
+        cfg.HTTPClient = &http.Client{Transport: this.new_data_transport()}
+    } else if transport, ok := client.Transport.(*http.Transport); ok {
+        // So warm_connections() and close_idle_connections() cover it.
+        this.mutex.Lock()
+        this.data_transports = append(this.data_transports, transport)
+        this.mutex.Unlock()
+    }
+    if aws.StringValue(base.Config.Region) == "" {
+        cfg.Region = aws.String("whatever")
+    }
+    if this.anonymous {
+        cfg.Credentials = credentials.AnonymousCredentials
+    } else if this.credentials_file != "" {
+        cfg.Credentials = this.file_credentials()
+    } else if this.require_credentials {
+        // The SDK always sets a credentials chain, which may be empty.
+        if base.Config.Credentials == nil {
+            return nil, &SessionError{Step: "credentials", Err: errors.New("the session has no credentials")}
+        }
+        if _, err := base.Config.Credentials.Get(); err != nil {
+            return nil, &SessionError{Step: "credentials", Err: err}
+        }
+    }
+    sess := base.Copy(&cfg)
+    this.install_handlers(sess, fake_domain)
+    return sess, nil
+}
+
+// install_handlers() adds to the session the request handlers which
+// balance its requests to fake_domain over the Alternator nodes.
+func (this *AlternatorNodes) install_handlers(sess *session.Session, fake_domain string) {
+    if this.user_agent != "" {
+        sess.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(this.user_agent))
+    }
+    // Allow overriding the region used in the signature per request, with
+    // ContextWithRegion(). As explained above, the region in the signature
+    // protects against replaying a request in a different region, so a
+    // request signed for one region is rejected (by servers which check
+    // it) in all others.
+    sess.Handlers.Sign.PushFront(func(r *request.Request) {
+        if region, ok := r.Context().Value(region_key{}).(string); ok && region != "" {
+            r.ClientInfo.SigningRegion = region
+        }
+    })
+    // A Host header set with ContextWithHost() must be set before signing,
+    // as the signature covers it. route() then keeps it.
+    sess.Handlers.Sign.PushFront(func(r *request.Request) {
+        if host := context_host(r); host != "" {
+            r.HTTPRequest.Host = host
+        }
+    })
+    // The same host and port as in fake_url().
+    fake_host := fmt.Sprintf("%s:%d", fake_domain, this.port_for(this.get_scheme()))
+    if this.host_header_strategy == HostHeaderRealNode {
+        // Pick the node before the request is signed, so the signature
+        // covers the real node's Host. The Send handler below will then
+        // leave this request alone, as it no longer uses fake_host.
+        sess.Handlers.Sign.PushFront(func(r *request.Request) {
+            if r.HTTPRequest.URL.Host == fake_host || reroute_retry(r) {
+                this.route(r, "")
+            }
+        })
+    }
+    sess.Handlers.CompleteAttempt.PushBack(this.record_attempt)
+    if this.clock_skew_detection {
+        sess.Handlers.CompleteAttempt.PushBack(this.check_response_clock_skew)
+    }
+    // Say in the error of a failed request which node it was sent to. The
+    // error returned by Send() can no longer be changed in Complete, so this
+    // is done after the retryer's decision: r.Error is still set only if the
+    // request will not be retried. Successful requests skip this entirely.
+    sess.Handlers.AfterRetry.PushBack(func(r *request.Request) {
+        if r.Error != nil && r.HTTPRequest.URL.Host != fake_host {
+            r.Error = &NodeError{Node: r.HTTPRequest.URL.Host, Err: r.Error}
+        }
+    })
+    if this.describe_endpoints_cache_minutes > 0 {
+        sess.Handlers.Unmarshal.PushBack(func(r *request.Request) {
+            if out, ok := r.Data.(*dynamodb.DescribeEndpointsOutput); ok && r.Error == nil {
+                for _, endpoint := range out.Endpoints {
+                    endpoint.CachePeriodInMinutes = aws.Int64(this.describe_endpoints_cache_minutes)
+                }
+            }
+        })
+    }
+    if this.retry_different_node {
+        sess.Handlers.Retry.PushBack(this.remember_failed_node)
+    }
+    if this.disable_seed_fallback || this.request_signer != nil {
+        // When route() fails with ErrNoNodes, or the WithRequestSigner()
+        // function fails, don't let the SDK's Send handler send the request
+        // anyway.
+        sess.Handlers.Send.AfterEachFn = request.HandlerListStopOnError
+    }
+    // The handlers pushed to the front of Send run in the reverse order, so
+    // these run after route() below, once the request is addressed to its
+    // node.
+    if this.tls_session_cache != nil {
+        sess.Handlers.Send.PushFront(this.trace_tls)
+    }
+    if this.request_signer != nil {
+        sess.Handlers.Send.PushFront(func(r *request.Request) {
+            if err := this.request_signer(r.HTTPRequest); err != nil {
+                r.Error = err
+                r.Retryable = aws.Bool(false)
+            }
+        })
     }
-    sess := session.Must(session.NewSession(&cfg))
     sess.Handlers.Send.PushFront(func(r *request.Request) {
-        // Only load-balance requests to the fake_domain.
-        fake_host := fmt.Sprintf("%s:%d", fake_domain, this.port)
-        if r.HTTPRequest.URL.Host == fake_host {
-            new_url := url.URL{Scheme: this.scheme, Host: fmt.Sprintf("%s:%d", this.pickone(), this.port)}
-            fmt.Printf("Alternator load balacing %s -> %s\n", r.HTTPRequest.URL.String(), new_url.String())
-            *r.HTTPRequest.URL = new_url
+        // Only load-balance requests to the fake_domain. Note that this
+        // isn't limited to the DynamoDB service: a DynamoDB Streams client
+        // created with dynamodbstreams.New(sess) uses the same endpoint, so
+        // its requests are balanced too. aws-sdk-go signs Streams requests
+        // with the signing name "dynamodb", which is what Alternator expects.
+        if r.HTTPRequest.URL.Host == fake_host || reroute_retry(r) {
             // The request is already signed with a signature including
             // fake_host. We must set the "Host" header in the request
             // to the same fake_host, or the signatures won't match.
-            // Note that HTTPRequest ignores the "Host" header - and instead
-            // has a spearate "Host" member:
-            r.HTTPRequest.Host = fake_host
+            this.route(r, fake_host)
         }
     })
-    return sess
+}
+
+// route() sends the given request, which was addressed to the fake domain,
+// to the node picked for it, and sets its Host header to host - or to the
+// node itself if host is empty. A Host header set with ContextWithHost()
+// takes precedence over both.
+func (this *AlternatorNodes) route(r *request.Request, host string) {
+    if this.refresh_only_on_request && !this.disable_topology_discovery {
+        this.update_on_request()
+    }
+    this.ensure_fresh(r.Context())
+    new_url, ok := r.Context().Value(node_key{}).(url.URL)
+    if !ok {
+        nodes := this.active()
+        node, err := nodes.pick_for_request(r)
+        if err != nil {
+            // Fail fast: the SDK would otherwise retry an unknown error.
+            r.Error = err
+            r.Retryable = aws.Bool(false)
+            return
+        }
+        if failed, ok := r.Context().Value(failed_node_key{}).(string); ok && nodes.node_url(node).Host == failed {
+            node = nodes.pick_other(failed)
+        }
+        new_url = nodes.node_url(node)
+        nodes.counters(new_url.Host).selected.Add(1)
+        if this.secondary != nil {
+            r.SetContext(context.WithValue(r.Context(), served_by_key{}, nodes))
+        }
+    }
+    this.log_rewrite(r.HTTPRequest.URL.String(), new_url)
+    *r.HTTPRequest.URL = new_url
+    if custom := context_host(r); custom != "" {
+        host = custom
+    } else if host == "" {
+        host = new_url.Host
+    }
+    // Note that HTTPRequest ignores the "Host" header - and instead
+    // has a spearate "Host" member:
+    r.HTTPRequest.Host = host
 }
@@ -0,0 +1,1055 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws"
+    "github.com/aws/aws-sdk-go/aws/credentials"
+    "github.com/aws/aws-sdk-go/aws/session"
+    "github.com/aws/aws-sdk-go/service/dynamodb"
+    "context"
+    "crypto/tls"
+    "encoding/pem"
+    "errors"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// new_test_server() starts an HTTP server listening on all addresses, so
+// every loopback address 127.0.0.x reaches it, and returns its port. The
+// handler can tell the nodes apart by r.Host on "/localnodes" requests,
+// and by their local address (http.LocalAddrContextKey) on any request.
+func new_test_server(t *testing.T, handler http.HandlerFunc) int {
+    srv := httptest.NewUnstartedServer(handler)
+    l, err := net.Listen("tcp", ":0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv.Listener = l
+    srv.Start()
+    t.Cleanup(srv.Close)
+    return l.Addr().(*net.TCPAddr).Port
+}
+
+// new_tls_test_server() starts an HTTPS server with the given handler, and
+// points AWS_CA_BUNDLE at its certificate, so the SDK trusts it. It
+// returns the server's port.
+func new_tls_test_server(t *testing.T, handler http.HandlerFunc) int {
+    srv := httptest.NewUnstartedServer(handler)
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv.Listener = l
+    srv.StartTLS()
+    t.Cleanup(srv.Close)
+    bundle := filepath.Join(t.TempDir(), "ca.pem")
+    cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+    if err := os.WriteFile(bundle, cert, 0600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("AWS_CA_BUNDLE", bundle)
+    return l.Addr().(*net.TCPAddr).Port
+}
+
+// answer_dynamodb() answers any DynamoDB request with an empty response,
+// which is enough for DescribeEndpoints.
+func answer_dynamodb(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+    w.Write([]byte(`{"Endpoints":[]}`))
+}
+
+// wait_for() waits until cond() is true, failing the test after 5 seconds.
+func wait_for(t *testing.T, cond func() bool) {
+    t.Helper()
+    for start := time.Now(); !cond(); time.Sleep(10*time.Millisecond) {
+        if time.Since(start) > 5*time.Second {
+            t.Fatal("timed out")
+        }
+    }
+}
+
+// capture_stdout() returns what f() printed, e.g., the library's warnings.
+func capture_stdout(t *testing.T, f func()) string {
+    t.Helper()
+    r, w, err := os.Pipe()
+    if err != nil {
+        t.Fatal(err)
+    }
+    stdout := os.Stdout
+    os.Stdout = w
+    f()
+    os.Stdout = stdout
+    w.Close()
+    b, err := io.ReadAll(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(b)
+}
+
+// make_stale() pretends the last successful update was an hour ago.
+func make_stale(nodes *AlternatorNodes) {
+    nodes.last_good.Store(&fetched_nodes{nodes: []string{"127.0.0.1"}, time: time.Now().Add(-time.Hour)})
+}
+
+// fetch_counter counts "/localnodes" requests, and the most which were in
+// progress at the same time.
+type fetch_counter struct {
+    fetches atomic.Int32
+    in_flight atomic.Int32
+    max_in_flight atomic.Int32
+}
+
+func (c *fetch_counter) start() func() {
+    c.fetches.Add(1)
+    n := c.in_flight.Add(1)
+    for m := c.max_in_flight.Load(); n > m && !c.max_in_flight.CompareAndSwap(m, n); m = c.max_in_flight.Load() {
+    }
+    return func() { c.in_flight.Add(-1) }
+}
+
+func TestMaxTopologyStalenessWaitsForOneUpdate(t *testing.T) {
+    for _, refresh_only_on_request := range []bool{false, true} {
+        var c fetch_counter
+        port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+            defer c.start()()
+            time.Sleep(50*time.Millisecond)
+            w.Write([]byte(`["127.0.0.1"]`))
+        })
+        nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"},
+            WithMaxTopologyStaleness(time.Minute), WithRefreshOnlyOnRequest(refresh_only_on_request))
+        make_stale(nodes)
+        before := c.fetches.Load()
+        var wg sync.WaitGroup
+        for i := 0; i < 20; i++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                nodes.next_node_e()
+            }()
+        }
+        wg.Wait()
+        if nodes.is_stale() {
+            t.Errorf("refresh_only_on_request=%v: the list is still stale", refresh_only_on_request)
+        }
+        // The update thread's first update may have been in progress.
+        if n := c.fetches.Load() - before; n < 1 || n > 2 {
+            t.Errorf("refresh_only_on_request=%v: %d fetches, expected 1 or 2", refresh_only_on_request, n)
+        }
+        if m := c.max_in_flight.Load(); m != 1 {
+            t.Errorf("refresh_only_on_request=%v: %d concurrent fetches", refresh_only_on_request, m)
+        }
+        nodes.stop()
+    }
+}
+
+func TestMaxTopologyStalenessBacksOffAfterFailure(t *testing.T) {
+    var fail atomic.Bool
+    var c fetch_counter
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        defer c.start()()
+        if fail.Load() {
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        w.Write([]byte(`["127.0.0.1"]`))
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"},
+        WithMaxTopologyStaleness(time.Minute), WithUpdateDeadline(200*time.Millisecond))
+    defer nodes.stop()
+    wait_for(t, func() bool { return nodes.last_good.Load() != nil })
+    fail.Store(true)
+    make_stale(nodes)
+    // The first request waits for the failing update...
+    start := time.Now()
+    nodes.next_node_e()
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("waited %v, expected at most twice the update deadline", d)
+    }
+    // ...but then requests don't wait for an update again for a while.
+    before := c.fetches.Load()
+    var wg sync.WaitGroup
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            start := time.Now()
+            nodes.next_node_e()
+            if d := time.Since(start); d > 50*time.Millisecond {
+                t.Errorf("request waited %v after a failed update", d)
+            }
+        }()
+    }
+    wg.Wait()
+    if n := c.fetches.Load() - before; n > 5 {
+        t.Errorf("%d fetches after a failed update", n)
+    }
+    if m := c.max_in_flight.Load(); m != 1 {
+        t.Errorf("%d concurrent fetches", m)
+    }
+}
+
+func TestMaxTopologyStalenessOnlyWhenStale(t *testing.T) {
+    var c fetch_counter
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        defer c.start()()
+        w.Write([]byte(`["127.0.0.1"]`))
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"},
+        WithRefreshOnlyOnRequest(true), WithMaxTopologyStaleness(time.Minute))
+    defer nodes.stop()
+    nodes.next_node_e()
+    if n := c.fetches.Load(); n != 1 {
+        t.Fatalf("%d fetches before the first request, expected 1", n)
+    }
+    // update_on_request() would refresh again after update_period.
+    nodes.mutex.Lock()
+    nodes.next_update = time.Now().Add(time.Hour)
+    nodes.mutex.Unlock()
+    nodes.next_node_e()
+    if n := c.fetches.Load(); n != 1 {
+        t.Errorf("a fresh list was fetched again")
+    }
+    make_stale(nodes)
+    nodes.next_node_e()
+    if n := c.fetches.Load(); n != 2 {
+        t.Errorf("a stale list was not fetched again")
+    }
+}
+
+func TestRequestSignerWithCABundle(t *testing.T) {
+    var gateway_token atomic.Value
+    port := new_tls_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        gateway_token.Store(r.Header.Get("X-Gateway-Token"))
+        answer_dynamodb(w, r)
+    })
+    fail := errors.New("no token")
+    var failing atomic.Bool
+    nodes := NewAlternatorNodes("https", port, []string{"127.0.0.1"},
+        WithStaticNodes([]string{"127.0.0.1"}), WithRequestSigner(func(r *http.Request) error {
+            if failing.Load() {
+                return fail
+            }
+            r.Header.Set("X-Gateway-Token", "secret")
+            return nil
+        }))
+    defer nodes.stop()
+    // The SDK can only apply AWS_CA_BUNDLE to a plain *http.Transport.
+    sess, err := nodes.new_session("dog.scylladb.com", "alternator", "secret_pass")
+    if err != nil {
+        t.Fatal(err)
+    }
+    db := dynamodb.New(sess)
+    if _, err := db.DescribeEndpoints(&dynamodb.DescribeEndpointsInput{}); err != nil {
+        t.Fatal(err)
+    }
+    if token, _ := gateway_token.Load().(string); token != "secret" {
+        t.Errorf("the signer's header was not sent")
+    }
+    failing.Store(true)
+    if _, err := db.DescribeEndpoints(&dynamodb.DescribeEndpointsInput{}); !errors.Is(err, fail) {
+        t.Errorf("got %v, expected the signer's error", err)
+    }
+}
+
+func TestLiveNodesWithAgeStaticNodes(t *testing.T) {
+    nodes := NewAlternatorNodes("http", 8000, []string{"10.0.0.1"},
+        WithStaticNodes([]string{"10.0.0.3", "10.0.0.2"}))
+    defer nodes.stop()
+    live, age := nodes.live_nodes_with_age()
+    if age != 0 || len(live) != 2 || live[0].Host != "10.0.0.2:8000" || live[1].Host != "10.0.0.3:8000" {
+        t.Errorf("got %v with age %v, expected the static nodes with age 0", live, age)
+    }
+    nodes = NewAlternatorNodes("http", 8000, []string{"10.0.0.1"}, WithDisableTopologyDiscovery(true))
+    defer nodes.stop()
+    live, age = nodes.live_nodes_with_age()
+    if age != 0 || len(live) != 1 || live[0].Host != "10.0.0.1:8000" {
+        t.Errorf("got %v with age %v, expected the seeds with age 0", live, age)
+    }
+}
+
+func TestParseRetryAfter(t *testing.T) {
+    for value, expected := range map[string]time.Duration{
+        "": 0,
+        "garbage": 0,
+        "-5": 0,
+        "3": 3*time.Second,
+        "86400": max_retry_after,
+        "99999999999999999": max_retry_after,
+        time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat): 0,
+        time.Now().Add(24*time.Hour).UTC().Format(http.TimeFormat): max_retry_after,
+    } {
+        if d := parse_retry_after(value); d != expected {
+            t.Errorf("parse_retry_after(%q) = %v, expected %v", value, d, expected)
+        }
+    }
+}
+
+func TestUpdateHonorsRetryAfter(t *testing.T) {
+    var overloaded atomic.Bool
+    overloaded.Store(true)
+    retry_after := "3"
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        if overloaded.Load() && strings.HasPrefix(r.Host, "127.0.0.1:") {
+            w.Header().Set("Retry-After", retry_after)
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        w.Write([]byte(`["127.0.0.2"]`))
+    })
+    // No update thread, so the test calls update() itself.
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"},
+        WithRefreshOnlyOnRequest(true), WithUpdateRetries(0))
+    defer nodes.stop()
+    if sleep := nodes.update(); sleep != 3*time.Second {
+        t.Errorf("next update in %v, expected the 3s the node asked for", sleep)
+    }
+    nodes.mutex.Lock()
+    until := nodes.backoff["127.0.0.1"]
+    nodes.mutex.Unlock()
+    if d := time.Until(until); d < 2*time.Second || d > 3*time.Second {
+        t.Errorf("node backed off for %v, expected 3s", d)
+    }
+    // An absurd delay is capped.
+    nodes.mutex.Lock()
+    delete(nodes.backoff, "127.0.0.1")
+    nodes.mutex.Unlock()
+    retry_after = "86400"
+    if sleep := nodes.update(); sleep != max_retry_after {
+        t.Errorf("next update in %v, expected at most %v", sleep, max_retry_after)
+    }
+}
+
+func TestUpdateSkipsNodeAskingToRetryLater(t *testing.T) {
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasPrefix(r.Host, "127.0.0.1:") {
+            w.Header().Set("Retry-After", "60")
+            w.WriteHeader(http.StatusTooManyRequests)
+            return
+        }
+        w.Write([]byte(`["127.0.0.2", "127.0.0.3"]`))
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1", "127.0.0.2"}, WithRefreshOnlyOnRequest(true))
+    defer nodes.stop()
+    // Whichever seed is asked first, the update succeeds within one cycle.
+    if sleep := nodes.update(); sleep != update_period {
+        t.Errorf("update failed")
+    }
+    if live := nodes.current_nodes(); len(live) != 2 {
+        t.Errorf("got nodes %v", live)
+    }
+}
+
+func TestLocalRackNodesQuery(t *testing.T) {
+    var query atomic.Value
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        query.Store(r.URL.RawQuery)
+        w.Write([]byte(`["127.0.0.1"]`))
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true),
+        WithRack("rack1"), WithDatacenter("dc2"), WithLocalNodesDCParam("datacenter"))
+    defer nodes.stop()
+    live, err := nodes.local_rack_nodes(context.Background())
+    if err != nil || len(live) != 1 {
+        t.Fatalf("got %v, %v", live, err)
+    }
+    if q, _ := query.Load().(string); q != "datacenter=dc2&rack=rack1" {
+        t.Errorf("sent query %q", q)
+    }
+}
+
+// counting_round_tripper counts the requests sent through it.
+type counting_round_tripper struct {
+    requests atomic.Int32
+}
+
+func (c *counting_round_tripper) RoundTrip(req *http.Request) (*http.Response, error) {
+    c.requests.Add(1)
+    return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestAugmentSessionKeepsHTTPClient(t *testing.T) {
+    port := new_test_server(t, answer_dynamodb)
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"}, WithStaticNodes([]string{"127.0.0.1"}))
+    defer nodes.stop()
+    // The SDK can't apply a CA bundle to a custom transport.
+    t.Setenv("AWS_CA_BUNDLE", "")
+    transport := &counting_round_tripper{}
+    base, err := session.NewSession(&aws.Config{
+        Region: aws.String("us-east-1"),
+        Credentials: credentials.NewStaticCredentials("alternator", "secret_pass", ""),
+        HTTPClient: &http.Client{Transport: transport, Timeout: 5*time.Second},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    sess, err := nodes.augment_session(base, "dog.scylladb.com")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if sess.Config.HTTPClient.Timeout != 5*time.Second {
+        t.Errorf("the session's HTTP client was replaced")
+    }
+    if _, err := dynamodb.New(sess).DescribeEndpoints(&dynamodb.DescribeEndpointsInput{}); err != nil {
+        t.Fatal(err)
+    }
+    if transport.requests.Load() != 1 {
+        t.Errorf("the request didn't go through the session's transport")
+    }
+    // The SDK's default client is replaced by ours.
+    base, err = session.NewSession(&aws.Config{Credentials: credentials.NewStaticCredentials("alternator", "secret_pass", "")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    sess, err = nodes.augment_session(base, "dog.scylladb.com")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := sess.Config.HTTPClient.Transport.(*http.Transport); !ok || sess.Config.HTTPClient == http.DefaultClient {
+        t.Errorf("the SDK's default client was kept")
+    }
+}
+
+func TestAugmentSessionRequireCredentials(t *testing.T) {
+    nodes := NewAlternatorNodes("http", 8000, []string{"127.0.0.1"},
+        WithStaticNodes([]string{"127.0.0.1"}), WithRequireCredentials(true))
+    defer nodes.stop()
+    base, err := session.NewSession(&aws.Config{Credentials: credentials.NewStaticCredentials("", "", "")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var serr *SessionError
+    if _, err := nodes.augment_session(base, "dog.scylladb.com"); !errors.As(err, &serr) || serr.Step != "credentials" {
+        t.Errorf("got %v, expected a credentials error", err)
+    }
+    base, err = session.NewSession(&aws.Config{Credentials: credentials.NewStaticCredentials("alternator", "secret_pass", "")})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := nodes.augment_session(base, "dog.scylladb.com"); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestNextNodeRefreshOnlyOnRequest(t *testing.T) {
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`["127.0.0.2"]`))
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"},
+        WithRefreshOnlyOnRequest(true), WithDisableSeedFallback(true))
+    defer nodes.stop()
+    node, err := nodes.next_node_e()
+    if err != nil || node.Host != "127.0.0.2:" + strconv.Itoa(port) {
+        t.Errorf("got %v, %v, expected the node from /localnodes", node, err)
+    }
+}
+
+func TestNextNodeFailoverAndRecovery(t *testing.T) {
+    var primary_down atomic.Bool
+    primary_down.Store(true)
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        if primary_down.Load() {
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        w.Write([]byte(`["127.0.0.1"]`))
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.9"},
+        WithRefreshOnlyOnRequest(true), WithUpdateRetries(0),
+        WithSecondaryNodes([]string{"127.0.0.2"}, WithStaticNodes([]string{"127.0.0.2"})))
+    defer nodes.stop()
+    // The primary cluster couldn't be reached for long.
+    nodes.mutex.Lock()
+    nodes.seed_fallback_since = time.Now().Add(-time.Hour)
+    nodes.mutex.Unlock()
+    primary, secondary := "127.0.0.1:" + strconv.Itoa(port), "127.0.0.2:" + strconv.Itoa(port)
+    for i := 0; i < 3; i++ {
+        if node, err := nodes.next_node_e(); err != nil || node.Host != secondary {
+            t.Fatalf("got %v, %v while the primary is down, expected %s", node, err, secondary)
+        }
+    }
+    // The primary comes back, and the next update of its list of nodes
+    // brings the traffic back to it.
+    primary_down.Store(false)
+    nodes.update()
+    for i := 0; i < 3; i++ {
+        if node, err := nodes.next_node_e(); err != nil || node.Host != primary {
+            t.Fatalf("got %v, %v after the primary came back, expected %s", node, err, primary)
+        }
+    }
+    if n := nodes.secondary.selection_histogram()[secondary]; n != 3 {
+        t.Errorf("%s was selected %d times, expected 3", secondary, n)
+    }
+}
+
+func TestNextNodeRateLimit(t *testing.T) {
+    nodes := NewAlternatorNodes("http", 8000, []string{"127.0.0.1"},
+        WithStaticNodes([]string{"127.0.0.1", "127.0.0.2"}), WithPerNodeRateLimit(1))
+    defer nodes.stop()
+    for i := 0; i < 4; i++ {
+        if _, err := nodes.next_node_e(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    var throttled uint64
+    for _, stat := range nodes.node_stats() {
+        throttled += stat.Throttled
+    }
+    // Each node has one token, so the last two picks find both nodes over
+    // their limit.
+    if throttled == 0 {
+        t.Errorf("no node was throttled")
+    }
+}
+
+func TestNewAlternatorNodesFromURLsHeterogeneous(t *testing.T) {
+    var hosts sync.Map
+    handler := func(w http.ResponseWriter, r *http.Request) {
+        // The Host header is the fake domain.
+        hosts.Store(r.Context().Value(http.LocalAddrContextKey).(net.Addr).String(), true)
+        answer_dynamodb(w, r)
+    }
+    port1 := new_test_server(t, handler)
+    port2 := new_test_server(t, handler)
+    nodes, err := NewAlternatorNodesFromURLs([]url.URL{
+        {Scheme: "http", Host: "127.0.0.1:" + strconv.Itoa(port1)},
+        {Scheme: "http", Host: "127.0.0.2:" + strconv.Itoa(port2)},
+    }, WithDisableTopologyDiscovery(true))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer nodes.stop()
+    db := dynamodb.New(nodes.session("dog.scylladb.com", "alternator", "secret_pass"))
+    for i := 0; i < 2; i++ {
+        if _, err := db.DescribeEndpoints(&dynamodb.DescribeEndpointsInput{}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for _, host := range []string{"127.0.0.1:" + strconv.Itoa(port1), "127.0.0.2:" + strconv.Itoa(port2)} {
+        if _, ok := hosts.Load(host); !ok {
+            t.Errorf("no request was sent to %s", host)
+        }
+    }
+    // Nodes without their own URL use the first URL's scheme and port.
+    if u := nodes.node_url("127.0.0.3"); u.String() != "http://127.0.0.3:" + strconv.Itoa(port1) {
+        t.Errorf("got %s", u.String())
+    }
+    if _, err := NewAlternatorNodesFromURLs([]url.URL{{Scheme: "http"}}); err == nil {
+        t.Errorf("a URL without a host was accepted")
+    }
+}
+
+func TestTriggerUpdateCoalesces(t *testing.T) {
+    var c fetch_counter
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        defer c.start()()
+        time.Sleep(50*time.Millisecond)
+        w.Write([]byte(`["127.0.0.1"]`))
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"})
+    defer nodes.stop()
+    wait_for(t, func() bool { return nodes.last_good.Load() != nil })
+    before := c.fetches.Load()
+    var wg sync.WaitGroup
+    for i := 0; i < 100; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            nodes.trigger_update()
+        }()
+    }
+    wg.Wait()
+    // Well before the next periodic update.
+    time.Sleep(300*time.Millisecond)
+    // One update for the triggers, and perhaps one more for those which
+    // came while it was in progress.
+    if n := c.fetches.Load() - before; n < 1 || n > 2 {
+        t.Errorf("%d fetches for 100 triggers, expected 1 or 2", n)
+    }
+    if m := c.max_in_flight.Load(); m != 1 {
+        t.Errorf("%d concurrent fetches", m)
+    }
+}
+
+func TestSeedFallbackUsesAllSeeds(t *testing.T) {
+    seeds := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+    // No update before the first request, so there are no live nodes.
+    nodes := NewAlternatorNodes("http", 8000, seeds, WithRefreshOnlyOnRequest(true))
+    defer nodes.stop()
+    picked := map[string]int{}
+    for i := 0; i < 6; i++ {
+        picked[nodes.pickone()]++
+    }
+    for _, seed := range seeds {
+        if picked[seed] != 2 {
+            t.Errorf("seed %s was picked %d times out of 6", seed, picked[seed])
+        }
+    }
+    // A seed which asked us to back off is skipped.
+    nodes.mutex.Lock()
+    nodes.backoff["10.0.0.2"] = time.Now().Add(time.Minute)
+    nodes.mutex.Unlock()
+    for i := 0; i < 4; i++ {
+        if node := nodes.pickone(); node == "10.0.0.2" {
+            t.Errorf("picked %s, which asked to back off", node)
+        }
+    }
+}
+
+func TestNextNodesWithoutLiveNodes(t *testing.T) {
+    seeds := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+    nodes := NewAlternatorNodes("http", 8000, seeds, WithRefreshOnlyOnRequest(true))
+    defer nodes.stop()
+    if a := nodes.next_nodes(2); len(a) != 2 || a[0].Hostname() != "10.0.0.1" || a[1].Hostname() != "10.0.0.2" {
+        t.Errorf("got %v, expected the first two seeds", a)
+    }
+    strict := NewAlternatorNodes("http", 8000, seeds, WithRefreshOnlyOnRequest(true), WithDisableSeedFallback(true))
+    defer strict.stop()
+    if a := strict.next_nodes(2); len(a) != 0 {
+        t.Errorf("got %v with WithDisableSeedFallback(), expected no nodes", a)
+    }
+    // Neither live nodes nor seeds.
+    empty := NewAlternatorNodes("http", 8000, nil, WithRefreshOnlyOnRequest(true))
+    defer empty.stop()
+    if a := empty.next_nodes(2); len(a) != 0 {
+        t.Errorf("got %v without any nodes", a)
+    }
+}
+
+func TestNodeIteratorWithoutLiveNodes(t *testing.T) {
+    seeds := []string{"10.0.0.1", "10.0.0.2"}
+    nodes := NewAlternatorNodes("http", 8000, seeds, WithRefreshOnlyOnRequest(true))
+    defer nodes.stop()
+    it := nodes.node_iterator()
+    if u := it.Next(); u.Hostname() != "10.0.0.1" {
+        t.Errorf("got %q, expected the first seed", u.String())
+    }
+    strict := NewAlternatorNodes("http", 8000, seeds, WithRefreshOnlyOnRequest(true), WithDisableSeedFallback(true))
+    defer strict.stop()
+    if u := strict.node_iterator().Next(); u != (url.URL{}) {
+        t.Errorf("got %q with WithDisableSeedFallback(), expected an empty URL", u.String())
+    }
+}
+
+func TestShrinkingNodeListStaysEven(t *testing.T) {
+    var shrunk atomic.Bool
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        if shrunk.Load() {
+            w.Write([]byte(`["127.0.0.1","127.0.0.2","127.0.0.3"]`))
+            return
+        }
+        var a []string
+        for i := 1; i <= 10; i++ {
+            a = append(a, strconv.Quote("127.0.0." + strconv.Itoa(i)))
+        }
+        w.Write([]byte("[" + strings.Join(a, ",") + "]"))
+    })
+    // All the 127.0.0.x nodes reach the test server.
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true))
+    defer nodes.stop()
+    nodes.update()
+    if n := len(nodes.current_nodes()); n != 10 {
+        t.Fatalf("got %d nodes, expected 10", n)
+    }
+    // Move the cursor beyond the end of the shrunk list.
+    for i := 0; i < 8; i++ {
+        nodes.pickone()
+    }
+    shrunk.Store(true)
+    nodes.update()
+    picked := map[string]int{}
+    for i := 0; i < 30; i++ {
+        picked[nodes.pickone()]++
+    }
+    for _, node := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+        if picked[node] != 10 {
+            t.Errorf("%s was picked %d times out of 30", node, picked[node])
+        }
+    }
+}
+
+func TestSpreadParallelScan(t *testing.T) {
+    var mutex sync.Mutex
+    var last string
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/localnodes" {
+            w.Write([]byte(`["127.0.0.1","127.0.0.2","127.0.0.3","127.0.0.4"]`))
+            return
+        }
+        mutex.Lock()
+        last = r.Context().Value(http.LocalAddrContextKey).(net.Addr).String()
+        mutex.Unlock()
+        answer_dynamodb(w, r)
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"},
+        WithRefreshOnlyOnRequest(true), WithSpreadParallelScan(true))
+    defer nodes.stop()
+    nodes.update()
+    db := dynamodb.New(nodes.session("dog.scylladb.com", "alternator", "secret_pass"))
+    scan := func(segment int64) string {
+        _, err := db.Scan(&dynamodb.ScanInput{
+            TableName: aws.String("table"), Segment: aws.Int64(segment), TotalSegments: aws.Int64(4)})
+        if err != nil {
+            t.Fatal(err)
+        }
+        mutex.Lock()
+        defer mutex.Unlock()
+        return last
+    }
+    segment_node := map[int64]string{}
+    used := map[string]bool{}
+    for segment := int64(0); segment < 4; segment++ {
+        segment_node[segment] = scan(segment)
+        used[segment_node[segment]] = true
+    }
+    if len(used) != 4 {
+        t.Errorf("4 segments were sent to %d nodes: %v", len(used), segment_node)
+    }
+    // Each segment stays on its node, regardless of other requests.
+    db.DescribeEndpoints(&dynamodb.DescribeEndpointsInput{})
+    for segment := int64(3); segment >= 0; segment-- {
+        if node := scan(segment); node != segment_node[segment] {
+            t.Errorf("segment %d moved from %s to %s", segment, segment_node[segment], node)
+        }
+    }
+}
+
+func TestUpdateRetriesAnotherSeed(t *testing.T) {
+    var first_failed atomic.Bool
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        // The first seed fails once.
+        if strings.HasPrefix(r.Host, "127.0.0.1:") && first_failed.CompareAndSwap(false, true) {
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        w.Write([]byte(`["127.0.0.1","127.0.0.2"]`))
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1", "127.0.0.2"},
+        WithRefreshOnlyOnRequest(true), WithUpdateRetries(2), WithUpdateBackoff(10*time.Millisecond))
+    defer nodes.stop()
+    start := time.Now()
+    if sleep := nodes.update(); sleep != update_period {
+        t.Errorf("update() failed, will retry after %v", sleep)
+    }
+    if d := time.Since(start); d > update_period {
+        t.Errorf("update() took %v, longer than a cycle", d)
+    }
+    if !first_failed.Load() {
+        t.Fatalf("the first seed was not tried first")
+    }
+    if n := len(nodes.current_nodes()); n != 2 {
+        t.Errorf("got %d nodes, expected 2", n)
+    }
+}
+
+func TestStopAbortsFetch(t *testing.T) {
+    started := make(chan struct{}, 1)
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        started <- struct{}{}
+        select {
+        case <-r.Context().Done():
+        case <-time.After(10*time.Second):
+        }
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"},
+        WithRefreshOnlyOnRequest(true), WithUpdateDeadline(time.Minute))
+    done := make(chan struct{})
+    go func() {
+        nodes.update()
+        close(done)
+    }()
+    <-started
+    start := time.Now()
+    nodes.stop()
+    select {
+    case <-done:
+        if d := time.Since(start); d > time.Second {
+            t.Errorf("the fetch returned %v after stop()", d)
+        }
+    case <-time.After(5*time.Second):
+        t.Fatal("the fetch did not return after stop()")
+    }
+}
+
+func TestUpdateDeadlineWithSlowSeeds(t *testing.T) {
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        if !strings.HasPrefix(r.Host, "127.0.0.4:") {
+            select {
+            case <-r.Context().Done():
+            case <-time.After(10*time.Second):
+            }
+            return
+        }
+        w.Write([]byte(`["127.0.0.4"]`))
+    })
+    deadline := 200*time.Millisecond
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.4"},
+        WithRefreshOnlyOnRequest(true), WithUpdateDeadline(deadline))
+    defer nodes.stop()
+    // Each update gives up on a slow seed within the deadline, and the
+    // next one goes on to the next seed, until it reaches the fast one.
+    for i := 0; i < 4 && nodes.last_good.Load() == nil; i++ {
+        start := time.Now()
+        nodes.update()
+        if d := time.Since(start); d > deadline + 500*time.Millisecond {
+            t.Errorf("update() took %v, with a deadline of %v", d, deadline)
+        }
+    }
+    if last_good := nodes.last_good.Load(); last_good == nil || len(last_good.nodes) != 1 || last_good.nodes[0] != "127.0.0.4" {
+        t.Errorf("the fast seed's list was not fetched")
+    }
+}
+
+func TestLocalNodesTLSConfig(t *testing.T) {
+    control := &tls.Config{ServerName: "control.example.com", MinVersion: tls.VersionTLS13}
+    nodes := NewAlternatorNodes("https", 8043, []string{"127.0.0.1"},
+        WithRefreshOnlyOnRequest(true), WithLocalNodesTLSConfig(control))
+    defer nodes.stop()
+    localnodes := nodes.client.Transport.(*http.Transport).TLSClientConfig
+    if localnodes == nil || localnodes.ServerName != control.ServerName || localnodes.MinVersion != tls.VersionTLS13 {
+        t.Errorf("the /localnodes transport has TLS config %+v", localnodes)
+    }
+    sess := nodes.session("dog.scylladb.com", "alternator", "secret_pass")
+    if data := sess.Config.HTTPClient.Transport.(*http.Transport).TLSClientConfig; data != nil && (data.ServerName != "" || data.MinVersion != 0) {
+        t.Errorf("the data transport has the /localnodes TLS config")
+    }
+
+    nodes = NewAlternatorNodes("https", 8043, []string{"127.0.0.1"},
+        WithRefreshOnlyOnRequest(true), WithLocalNodesIgnoreCertError(true))
+    defer nodes.stop()
+    if localnodes := nodes.client.Transport.(*http.Transport).TLSClientConfig; localnodes == nil || !localnodes.InsecureSkipVerify {
+        t.Errorf("the /localnodes transport verifies certificates")
+    }
+    sess = nodes.session("dog.scylladb.com", "alternator", "secret_pass")
+    if data := sess.Config.HTTPClient.Transport.(*http.Transport).TLSClientConfig; data != nil && data.InsecureSkipVerify {
+        t.Errorf("the data transport doesn't verify certificates")
+    }
+}
+
+func TestLocalNodesQueryParams(t *testing.T) {
+    var query atomic.Value
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        query.Store(r.URL.RawQuery)
+        w.Write([]byte(`["127.0.0.1"]`))
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true),
+        WithRack("rack1"), WithDatacenter("dc1"))
+    defer nodes.stop()
+    nodes.update()
+    if q, _ := query.Load().(string); q != "dc=dc1&rack=rack1" {
+        t.Errorf("sent query %q with the default parameter names", q)
+    }
+    nodes = NewAlternatorNodes("http", port, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true),
+        WithRack("rack1"), WithDatacenter("dc1"),
+        WithLocalNodesRackParam("availability_zone"), WithLocalNodesDCParam("datacenter"))
+    defer nodes.stop()
+    nodes.update()
+    if q, _ := query.Load().(string); q != "availability_zone=rack1&datacenter=dc1" {
+        t.Errorf("sent query %q with custom parameter names", q)
+    }
+}
+
+func TestValidateClientCertConfigError(t *testing.T) {
+    no_cert := errors.New("no certificate")
+    invalid := []Option{WithRefreshOnlyOnRequest(true), WithValidateClientCert(true),
+        WithClientCertificateProvider(func() (*tls.Certificate, error) { return nil, no_cert })}
+    var cerr *ConfigError
+    if nodes, err := NewAlternatorNodesE("https", 8043, []string{"127.0.0.1"}, invalid...); nodes != nil || !errors.As(err, &cerr) ||
+            cerr.Option != "WithValidateClientCert" || !errors.Is(err, no_cert) {
+        t.Errorf("got %v, expected a ConfigError", err)
+    }
+    if _, err := NewBuilder().Scheme("https").Port(8043).Nodes("127.0.0.1").Options(invalid...).Build(); !errors.As(err, &cerr) {
+        t.Errorf("Build() returned %v, expected a ConfigError", err)
+    }
+    // Also in the options of the secondary cluster.
+    _, err := NewAlternatorNodesE("https", 8043, []string{"127.0.0.1"},
+        WithRefreshOnlyOnRequest(true), WithSecondaryNodes([]string{"127.0.0.2"}, invalid...))
+    if !errors.As(err, &cerr) {
+        t.Errorf("got %v for the secondary's options, expected a ConfigError", err)
+    }
+    // NewAlternatorNodes() only prints the error.
+    nodes := NewAlternatorNodes("https", 8043, []string{"127.0.0.1"}, invalid...)
+    if nodes == nil {
+        t.Fatal("NewAlternatorNodes() returned nil")
+    }
+    nodes.stop()
+}
+
+func TestLocalAddrConfigError(t *testing.T) {
+    // 203.0.113.0/24 is reserved for documentation, so it isn't ours.
+    _, err := NewAlternatorNodesE("http", 8000, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true),
+        WithLocalAddr(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}))
+    var cerr *ConfigError
+    if !errors.As(err, &cerr) || cerr.Option != "WithLocalAddr" {
+        t.Errorf("got %v, expected a ConfigError", err)
+    }
+    nodes, err := NewAlternatorNodesE("http", 8000, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true),
+        WithLocalAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}))
+    if err != nil {
+        t.Fatal(err)
+    }
+    nodes.stop()
+}
+
+func TestPortCandidatesConfigError(t *testing.T) {
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`["127.0.0.1"]`))
+    })
+    // A port on which nothing listens.
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    closed := l.Addr().(*net.TCPAddr).Port
+    l.Close()
+    nodes, err := NewAlternatorNodesE("http", 8000, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true),
+        WithPortCandidates([]int{closed, port}))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer nodes.stop()
+    if nodes.port != port {
+        t.Errorf("using port %d, expected %d", nodes.port, port)
+    }
+    _, err = NewAlternatorNodesE("http", 8000, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true),
+        WithPortCandidates([]int{closed}))
+    var cerr *ConfigError
+    if !errors.As(err, &cerr) || cerr.Option != "WithPortCandidates" {
+        t.Errorf("got %v, expected a ConfigError", err)
+    }
+}
+
+func TestDefaultUserAgent(t *testing.T) {
+    var localnodes_ua, data_ua atomic.Value
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/localnodes" {
+            localnodes_ua.Store(r.UserAgent())
+            w.Write([]byte(`["127.0.0.1"]`))
+            return
+        }
+        data_ua.Store(r.UserAgent())
+        answer_dynamodb(w, r)
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true))
+    defer nodes.stop()
+    db := dynamodb.New(nodes.session("dog.scylladb.com", "alternator", "secret_pass"))
+    if _, err := db.DescribeEndpoints(&dynamodb.DescribeEndpointsInput{}); err != nil {
+        t.Fatal(err)
+    }
+    expected := "alternator-load-balancing-go/" + version
+    if ua, _ := localnodes_ua.Load().(string); ua != expected {
+        t.Errorf("/localnodes User-Agent %q, expected %q", ua, expected)
+    }
+    if ua, _ := data_ua.Load().(string); !strings.HasSuffix(ua, expected) {
+        t.Errorf("data User-Agent %q doesn't end with %q", ua, expected)
+    }
+}
+
+func TestRefreshOnlyOnRequestAfterUpdatePeriod(t *testing.T) {
+    var c fetch_counter
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        defer c.start()()
+        w.Write([]byte(`["127.0.0.1"]`))
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true))
+    defer nodes.stop()
+    nodes.update_on_request()
+    nodes.update_on_request()
+    if n := c.fetches.Load(); n != 1 {
+        t.Fatalf("%d fetches, expected 1 until update_period passes", n)
+    }
+    // However long the client was idle, the first request after
+    // update_period refreshes the list.
+    nodes.mutex.Lock()
+    nodes.next_update = time.Now().Add(-time.Hour)
+    nodes.mutex.Unlock()
+    nodes.update_on_request()
+    if n := c.fetches.Load(); n != 2 {
+        t.Errorf("%d fetches, expected a refresh after update_period", n)
+    }
+}
+
+func TestSessionHasItsOwnClient(t *testing.T) {
+    nodes := NewAlternatorNodes("http", 8000, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true))
+    defer nodes.stop()
+    sess := nodes.session("dog.scylladb.com", "alternator", "secret_pass")
+    data := sess.Config.HTTPClient
+    if data == nil || data == nodes.client {
+        t.Fatalf("the session uses the /localnodes client")
+    }
+    if data.Transport == nil || data.Transport == nodes.client.Transport {
+        t.Errorf("the session shares the /localnodes transport")
+    }
+}
+
+func TestOptionsReachBothClients(t *testing.T) {
+    proxy_url, _ := url.Parse("http://proxy.example.com:3128")
+    for _, c := range []struct {
+        name string
+        option Option
+        check func(*http.Transport) bool
+    }{
+        {"WithResponseHeaderTimeout", WithResponseHeaderTimeout(7*time.Second), func(transport *http.Transport) bool {
+            return transport.ResponseHeaderTimeout == 7*time.Second
+        }},
+        {"WithProxy", WithProxy(http.ProxyURL(proxy_url)), func(transport *http.Transport) bool {
+            req, _ := http.NewRequest("GET", "http://127.0.0.1:8000/", nil)
+            u, err := transport.Proxy(req)
+            return err == nil && u != nil && u.String() == proxy_url.String()
+        }},
+        {"WithNoProxy", WithNoProxy([]string{"127.0.0.1"}), func(transport *http.Transport) bool {
+            req, _ := http.NewRequest("GET", "http://127.0.0.1:8000/", nil)
+            u, err := transport.Proxy(req)
+            return err == nil && u == nil
+        }},
+    } {
+        options := []Option{WithRefreshOnlyOnRequest(true), c.option}
+        if c.name == "WithNoProxy" {
+            options = append(options, WithProxy(http.ProxyURL(proxy_url)))
+        }
+        nodes := NewAlternatorNodes("http", 8000, []string{"127.0.0.1"}, options...)
+        sess := nodes.session("dog.scylladb.com", "alternator", "secret_pass")
+        if transport, ok := nodes.client.Transport.(*http.Transport); !ok || !c.check(transport) {
+            t.Errorf("%s did not reach the /localnodes client", c.name)
+        }
+        if transport, ok := sess.Config.HTTPClient.Transport.(*http.Transport); !ok || !c.check(transport) {
+            t.Errorf("%s did not reach the session's client", c.name)
+        }
+        nodes.stop()
+    }
+}
+
+func TestLocalNodesUseConfiguredTransport(t *testing.T) {
+    var requests atomic.Int32
+    var target atomic.Value
+    // A forward proxy, which answers "/localnodes" itself.
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        requests.Add(1)
+        target.Store(r.URL.String())
+        w.Write([]byte(`["10.0.0.1","10.0.0.2"]`))
+    })
+    proxy_url := &url.URL{Scheme: "http", Host: "127.0.0.1:" + strconv.Itoa(port)}
+    nodes := NewAlternatorNodes("http", 8000, []string{"10.0.0.1"},
+        WithRefreshOnlyOnRequest(true), WithProxy(http.ProxyURL(proxy_url)))
+    defer nodes.stop()
+    nodes.update()
+    if n := requests.Load(); n != 1 {
+        t.Fatalf("the proxy got %d requests, expected 1", n)
+    }
+    if u, _ := target.Load().(string); u != "http://10.0.0.1:8000/localnodes" {
+        t.Errorf("the proxy got a request for %s", u)
+    }
+    if a := nodes.current_nodes(); len(a) != 2 {
+        t.Errorf("got %v from the proxy", a)
+    }
+}
@@ -0,0 +1,99 @@
+// A fluent builder for AlternatorNodes, as an alternative to passing a long
+// list of options to NewAlternatorNodes(). The options remain the main way
+// to configure it: the builder only collects them.
+//
+//    alternator_nodes, sess, err := NewBuilder().
+//        Scheme("https").Port(8043).Nodes("10.0.0.1", "10.0.0.2").
+//        Rack("rack1").Credentials("alternator", "secret_pass").
+//        BuildSession("dog.scylladb.com")
+
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws/session"
+    "errors"
+    "fmt"
+)
+
+// Builder collects the configuration of an AlternatorNodes object, see
+// NewBuilder().
+type Builder struct {
+    scheme string
+    port int
+    nodes []string
+    options []Option
+    key string
+    secret_key string
+}
+
+// NewBuilder() returns a Builder with the scheme "http" and port 8000, the
+// defaults of Alternator.
+func NewBuilder() *Builder {
+    return &Builder{scheme: "http", port: 8000}
+}
+
+func (b *Builder) Scheme(scheme string) *Builder {
+    b.scheme = scheme
+    return b
+}
+
+func (b *Builder) Port(port int) *Builder {
+    b.port = port
+    return b
+}
+
+// Nodes() adds known nodes, as given to NewAlternatorNodes().
+func (b *Builder) Nodes(nodes ...string) *Builder {
+    b.nodes = append(b.nodes, nodes...)
+    return b
+}
+
+func (b *Builder) Rack(rack string) *Builder {
+    return b.Options(WithRack(rack))
+}
+
+func (b *Builder) Datacenter(datacenter string) *Builder {
+    return b.Options(WithDatacenter(datacenter))
+}
+
+// Options() adds any of the options accepted by NewAlternatorNodes().
+func (b *Builder) Options(options ...Option) *Builder {
+    b.options = append(b.options, options...)
+    return b
+}
+
+// Credentials() sets the key and secret key used by BuildSession().
+func (b *Builder) Credentials(key, secret_key string) *Builder {
+    b.key, b.secret_key = key, secret_key
+    return b
+}
+
+// Build() checks the configuration, and creates the AlternatorNodes object,
+// see NewAlternatorNodesE().
+func (b *Builder) Build() (*AlternatorNodes, error) {
+    if b.scheme != "http" && b.scheme != "https" {
+        return nil, fmt.Errorf("unsupported scheme %q", b.scheme)
+    }
+    if b.port <= 0 || b.port > 65535 {
+        return nil, fmt.Errorf("invalid port %d", b.port)
+    }
+    if len(b.nodes) == 0 {
+        return nil, errors.New("no known nodes were given")
+    }
+    return NewAlternatorNodesE(b.scheme, b.port, b.nodes, b.options...)
+}
+
+// BuildSession() is Build(), followed by new_session() with the given fake
+// domain and the Credentials().
+func (b *Builder) BuildSession(fake_domain string) (*AlternatorNodes, *session.Session, error) {
+    nodes, err := b.Build()
+    if err != nil {
+        return nil, nil, err
+    }
+    sess, err := nodes.new_session(fake_domain, b.key, b.secret_key)
+    if err != nil {
+        nodes.stop()
+        return nil, nil, err
+    }
+    return nodes, sess, nil
+}
@@ -0,0 +1,125 @@
+// Support for client certificates (mTLS) on the connections to the
+// Alternator nodes, where the certificate is obtained from a user-supplied
+// function - e.g., one fetching short-lived certificates from a secrets
+// manager - instead of from a fixed file.
+
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "time"
+)
+
+// How long a certificate returned by the client certificate provider is
+// reused before calling the provider again, unless changed with
+// WithClientCertificateCacheTTL().
+const default_client_cert_cache_ttl = 1*time.Minute
+
+// WithClientCertificateProvider() sets a function which returns the client
+// certificate to present to the nodes during the TLS handshake. It is
+// called again when the certificate cached from the previous call is
+// older than the cache TTL, so rotated certificates are picked up without
+// recreating the AlternatorNodes object.
+func WithClientCertificateProvider(provider func() (*tls.Certificate, error)) Option {
+    return func(this *AlternatorNodes) {
+        this.client_cert_provider = provider
+    }
+}
+
+// WithClientCertificateCacheTTL() sets for how long a certificate returned
+// by the client certificate provider is reused. Zero means the provider is
+// called on every TLS handshake.
+func WithClientCertificateCacheTTL(ttl time.Duration) Option {
+    return func(this *AlternatorNodes) {
+        this.client_cert_cache_ttl = ttl
+    }
+}
+
+// client_certificate() is used as the tls.Config's GetClientCertificate
+// callback. If the provider fails, the previously cached certificate (if
+// any) is used, so a temporary failure of the secrets manager doesn't
+// break new connections.
+func (this *AlternatorNodes) client_certificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+    this.client_cert_mutex.Lock()
+    defer this.client_cert_mutex.Unlock()
+    if this.client_cert != nil && time.Since(this.client_cert_time) < this.client_cert_cache_ttl {
+        return this.client_cert, nil
+    }
+    cert, err := this.client_cert_provider()
+    if err != nil {
+        if this.client_cert != nil {
+            return this.client_cert, nil
+        }
+        return nil, err
+    }
+    this.client_cert = cert
+    this.client_cert_time = time.Now()
+    return cert, nil
+}
+
+// WithValidateClientCert() makes NewAlternatorNodes() check the client
+// certificate with validate_client_certificate(), and report a problem
+// immediately, instead of as a cryptic TLS handshake failure later.
+// NewAlternatorNodesE() returns the problem as a *ConfigError.
+func WithValidateClientCert(enabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.validate_client_cert = enabled
+    }
+}
+
+// WithClientCertCA() sets the CA certificates which the client certificate
+// is expected to chain to. It is only used by validate_client_certificate().
+func WithClientCertCA(roots *x509.CertPool) Option {
+    return func(this *AlternatorNodes) {
+        this.client_cert_ca = roots
+    }
+}
+
+// validate_client_certificate() checks that the client certificate can be
+// obtained from the provider, parses, is currently valid, and - if a CA
+// was given with WithClientCertCA() - chains to that CA.
+func (this *AlternatorNodes) validate_client_certificate() error {
+    if this.client_cert_provider == nil {
+        return errors.New("no client certificate provider configured")
+    }
+    cert, err := this.client_certificate(nil)
+    if err != nil {
+        return fmt.Errorf("failed to get client certificate: %w", err)
+    }
+    if cert == nil || len(cert.Certificate) == 0 {
+        return errors.New("client certificate provider returned an empty certificate")
+    }
+    leaf, err := x509.ParseCertificate(cert.Certificate[0])
+    if err != nil {
+        return fmt.Errorf("failed to parse client certificate: %w", err)
+    }
+    now := time.Now()
+    if now.Before(leaf.NotBefore) {
+        return fmt.Errorf("client certificate %q is not valid before %v", leaf.Subject, leaf.NotBefore)
+    }
+    if now.After(leaf.NotAfter) {
+        return fmt.Errorf("client certificate %q expired at %v", leaf.Subject, leaf.NotAfter)
+    }
+    if this.client_cert_ca != nil {
+        intermediates := x509.NewCertPool()
+        for _, der := range cert.Certificate[1:] {
+            c, err := x509.ParseCertificate(der)
+            if err != nil {
+                return fmt.Errorf("failed to parse client certificate chain: %w", err)
+            }
+            intermediates.AddCert(c)
+        }
+        _, err := leaf.Verify(x509.VerifyOptions{
+            Roots: this.client_cert_ca,
+            Intermediates: intermediates,
+            KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+        })
+        if err != nil {
+            return fmt.Errorf("client certificate %q does not chain to the expected CA: %w", leaf.Subject, err)
+        }
+    }
+    return nil
+}
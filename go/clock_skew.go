@@ -0,0 +1,61 @@
+// Detection of a skewed local clock. Requests are signed with the local
+// time, and a node rejects a signature whose time is too far from its own,
+// which looks just like a wrong key. See WithClockSkewDetection().
+
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws/request"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+// A difference between the local clock and a node's clock above this is
+// warned about. The Date header only has a resolution of one second, and
+// the response takes some time to arrive, so smaller differences can't be
+// measured reliably anyway.
+const clock_skew_threshold = 1*time.Minute
+
+// WithClockSkewDetection() compares the Date header of responses from the
+// nodes, both to "/localnodes" requests and to data requests, to the local
+// clock, and prints a warning if they differ by more than a minute. A large
+// skew makes the nodes reject the requests' signatures, with an error which
+// looks like bad credentials. The warning is printed once, and again only
+// after the skew went away and came back.
+func WithClockSkewDetection(enabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.clock_skew_detection = enabled
+    }
+}
+
+// check_clock_skew() compares the Date header of a response from the given
+// node with the local clock, see WithClockSkewDetection().
+func (this *AlternatorNodes) check_clock_skew(node string, resp *http.Response) {
+    if !this.clock_skew_detection || resp == nil {
+        return
+    }
+    date, err := http.ParseTime(resp.Header.Get("Date"))
+    if err != nil {
+        return
+    }
+    skew := time.Since(date)
+    if skew < 0 {
+        skew = -skew
+    }
+    if skew <= clock_skew_threshold {
+        this.clock_skew_warned.Store(false)
+        return
+    }
+    if this.clock_skew_warned.CompareAndSwap(false, true) {
+        fmt.Printf("Alternator WARNING: the local clock differs from the clock of node %s by about %v. "+
+            "Requests are signed with the local time, and will be rejected as if the credentials were wrong "+
+            "if the difference is too large - fix the clock, not the credentials.\n", node, skew.Round(time.Second))
+    }
+}
+
+// check_response_clock_skew() is a CompleteAttempt handler calling
+// check_clock_skew() on each response to a data request.
+func (this *AlternatorNodes) check_response_clock_skew(r *request.Request) {
+    this.check_clock_skew(r.HTTPRequest.URL.Host, r.HTTPResponse)
+}
@@ -0,0 +1,115 @@
+// Support for reading the credentials from a file which is replaced when
+// they are rotated, e.g., by a secrets manager's agent, so sessions pick up
+// new credentials without being recreated. See WithCredentialsFile().
+
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws/credentials"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// How often the credentials file is checked for changes.
+const credentials_file_check_period = 1*time.Second
+
+// WithCredentialsFile() makes sessions read the key and secret key from the
+// given file, instead of using those given to session(). The file holds
+// either a JSON object {"key": "...", "secret_key": "..."}, or the key and
+// the secret key on two lines. It is read again when it changes, so rotated
+// credentials take effect without a restart. If reading it fails, the last
+// credentials read successfully keep being used, and the error is printed.
+func WithCredentialsFile(path string) Option {
+    return func(this *AlternatorNodes) {
+        this.credentials_file = path
+    }
+}
+
+// file_credentials_provider is a credentials.Provider reading the
+// credentials from a file, see WithCredentialsFile().
+type file_credentials_provider struct {
+    path string
+    mutex sync.Mutex
+    value credentials.Value
+    mod_time time.Time
+    checked time.Time
+}
+
+// Retrieve() reads the credentials file. If that fails, the previous
+// credentials are returned, if there are any.
+func (p *file_credentials_provider) Retrieve() (credentials.Value, error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.checked = time.Now()
+    info, err := os.Stat(p.path)
+    if err == nil {
+        // Even if this version of the file is bad, don't read it again
+        // until it changes.
+        p.mod_time = info.ModTime()
+        var value credentials.Value
+        value, err = read_credentials_file(p.path)
+        if err == nil {
+            p.value = value
+            return value, nil
+        }
+    }
+    if p.value.AccessKeyID != "" {
+        fmt.Println("Alternator credentials file ERROR, keeping the previous credentials:", err.Error())
+        return p.value, nil
+    }
+    return credentials.Value{}, err
+}
+
+// IsExpired() returns true if the credentials file changed since it was
+// read. To avoid checking the file on every request, it is only checked
+// once every credentials_file_check_period.
+func (p *file_credentials_provider) IsExpired() bool {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    if time.Since(p.checked) < credentials_file_check_period {
+        return false
+    }
+    info, err := os.Stat(p.path)
+    if err == nil && !info.ModTime().Equal(p.mod_time) {
+        // Stays expired until Retrieve() reads the new file.
+        return true
+    }
+    p.checked = time.Now()
+    return false
+}
+
+func read_credentials_file(path string) (credentials.Value, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return credentials.Value{}, err
+    }
+    var key, secret_key string
+    if text := strings.TrimSpace(string(data)); strings.HasPrefix(text, "{") {
+        var parsed struct {
+            Key string `json:"key"`
+            SecretKey string `json:"secret_key"`
+        }
+        if err := json.Unmarshal(data, &parsed); err != nil {
+            return credentials.Value{}, fmt.Errorf("%s: %w", path, err)
+        }
+        key, secret_key = parsed.Key, parsed.SecretKey
+    } else if lines := strings.Split(text, "\n"); len(lines) == 2 {
+        key, secret_key = strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1])
+    }
+    if key == "" || secret_key == "" {
+        return credentials.Value{}, errors.New(path + ": expected a key and a secret key")
+    }
+    return credentials.Value{AccessKeyID: key, SecretAccessKey: secret_key, ProviderName: "AlternatorCredentialsFile"}, nil
+}
+
+// file_credentials() returns the credentials read from the
+// WithCredentialsFile() file.
+func (this *AlternatorNodes) file_credentials() *credentials.Credentials {
+    return credentials.NewCredentials(&file_credentials_provider{path: this.credentials_file})
+}
@@ -0,0 +1,90 @@
+// An in-process cache of DNS resolutions of the nodes' host names, so new
+// connections to a node don't each have to resolve its name again. See
+// WithDNSCacheTTL().
+
+package main
+
+import (
+    "context"
+    "net"
+    "sync"
+    "time"
+)
+
+// WithDNSCacheTTL() caches the addresses that node host names resolve to,
+// for the given time, for both "/localnodes" requests and data requests.
+// When connecting to all the cached addresses of a host fails, its entry is
+// dropped, so the next connection resolves the name again. Nodes given as
+// IP addresses are not affected. Zero (the default) disables the cache.
+func WithDNSCacheTTL(ttl time.Duration) Option {
+    return func(this *AlternatorNodes) {
+        this.dns_cache_ttl = ttl
+    }
+}
+
+type dns_entry struct {
+    addrs []string
+    expires time.Time
+}
+
+// dns_cache holds the resolved addresses of each host name.
+type dns_cache struct {
+    ttl time.Duration
+    mutex sync.Mutex
+    entries map[string]dns_entry
+}
+
+func new_dns_cache(ttl time.Duration) *dns_cache {
+    return &dns_cache{ttl: ttl, entries: make(map[string]dns_entry)}
+}
+
+// lookup() returns the addresses of host, from the cache if they are there
+// and haven't expired, and resolving it otherwise.
+func (c *dns_cache) lookup(ctx context.Context, host string) ([]string, error) {
+    now := time.Now()
+    c.mutex.Lock()
+    entry, ok := c.entries[host]
+    c.mutex.Unlock()
+    if ok && now.Before(entry.expires) {
+        return entry.addrs, nil
+    }
+    addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+    if err != nil {
+        return nil, err
+    }
+    c.mutex.Lock()
+    c.entries[host] = dns_entry{addrs: addrs, expires: now.Add(c.ttl)}
+    c.mutex.Unlock()
+    return addrs, nil
+}
+
+func (c *dns_cache) invalidate(host string) {
+    c.mutex.Lock()
+    delete(c.entries, host)
+    c.mutex.Unlock()
+}
+
+// wrap() wraps a transport's DialContext function, to connect to the cached
+// addresses of the host instead of resolving it on every connection.
+func (c *dns_cache) wrap(
+        dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+    return func(ctx context.Context, network, addr string) (net.Conn, error) {
+        host, port, err := net.SplitHostPort(addr)
+        if err != nil || net.ParseIP(host) != nil {
+            return dial(ctx, network, addr)
+        }
+        addrs, err := c.lookup(ctx, host)
+        if err != nil {
+            return nil, err
+        }
+        for _, a := range addrs {
+            var conn net.Conn
+            conn, err = dial(ctx, network, net.JoinHostPort(a, port))
+            if err == nil {
+                return conn, nil
+            }
+        }
+        c.invalidate(host)
+        return nil, err
+    }
+}
@@ -0,0 +1,174 @@
+// A snapshot of the configuration an AlternatorNodes object actually uses,
+// after applying all the options, for debugging.
+
+package main
+
+import (
+    "context"
+    "time"
+)
+
+// ConfigSnapshot is the configuration of an AlternatorNodes object, as
+// returned by effective_config(). Options which take a function (such as
+// WithProxy()), or a certificate pool (WithClientCertCA()), are only
+// reported as set or not. WithStaticNodes() is reported as TopologyDiscovery
+// being off; the nodes themselves are returned by live_nodes_with_age(). The object doesn't keep
+// any secrets - the credentials are given to session(), and of a
+// WithCredentialsFile() only the path is reported - so there is nothing
+// here to redact. It can be marshaled to JSON as is, e.g., for a
+// debug endpoint; durations are then in nanoseconds, as the "_ns" suffix
+// of their names says.
+type ConfigSnapshot struct {
+    Scheme string `json:"scheme"`
+    Port int `json:"port"`
+    PortForScheme map[string]int `json:"port_for_scheme"`
+    PortCandidates []int `json:"port_candidates"`
+    SchemeAutoDetect bool `json:"scheme_auto_detect"`
+    Seeds []string `json:"seeds"`
+    Rack string `json:"rack"`
+    Datacenter string `json:"datacenter"`
+    RackParam string `json:"rack_param"`
+    DatacenterParam string `json:"datacenter_param"`
+    UserAgent string `json:"user_agent"`
+    UpdatePeriod time.Duration `json:"update_period_ns"`
+    TopologyDiscovery bool `json:"topology_discovery"`
+    RefreshOnlyOnRequest bool `json:"refresh_only_on_request"`
+    MaxTopologyStaleness time.Duration `json:"max_topology_staleness_ns"`
+    UpdateRetries int `json:"update_retries"`
+    UpdateBackoff time.Duration `json:"update_backoff_ns"`
+    UpdateDeadline time.Duration `json:"update_deadline_ns"`
+    WarmConnectionsOnUpdate bool `json:"warm_connections_on_update"`
+    NodeSubsetSize int `json:"node_subset_size"`
+    ClientID string `json:"client_id"`
+    LatencyAwareRouting bool `json:"latency_aware_routing"`
+    SeedFallback bool `json:"seed_fallback"`
+    SeedFallbackWarning time.Duration `json:"seed_fallback_warning_ns"`
+    SeedFallbackCallback bool `json:"seed_fallback_callback"`
+    WarnOnSeedMismatch bool `json:"warn_on_seed_mismatch"`
+    FollowLocalNodesRedirects bool `json:"follow_localnodes_redirects"`
+    NodeAddressMapper bool `json:"node_address_mapper"`
+    NodeEqualFunc bool `json:"node_equal_func"`
+    DNSCacheTTL time.Duration `json:"dns_cache_ttl_ns"`
+    RetryDifferentNode bool `json:"retry_different_node"`
+    RetryableErrorFunc bool `json:"retryable_error_func"`
+    CustomContext bool `json:"custom_context"`
+    StickyControlPlaneNode bool `json:"sticky_control_plane_node"`
+    HealthMinNodes int `json:"health_min_nodes"`
+    HealthMaxStaleness time.Duration `json:"health_max_staleness_ns"`
+    ClockSkewDetection bool `json:"clock_skew_detection"`
+    PerNodeRateLimit int `json:"per_node_rate_limit"`
+    InitialCursor uint64 `json:"initial_cursor"`
+    PreserveServerOrder bool `json:"preserve_server_order"`
+    PreferredNodes []string `json:"preferred_nodes"`
+    SelectionStride int `json:"selection_stride"`
+    SpreadParallelScan bool `json:"spread_parallel_scan"`
+    AllowEmptyNodeList bool `json:"allow_empty_node_list"`
+    SecondarySeeds []string `json:"secondary_seeds"`
+    CloseConnectionsOnTopologyChange bool `json:"close_connections_on_topology_change"`
+    CredentialsFile string `json:"credentials_file"`
+    RequireCredentials bool `json:"require_credentials"`
+    DescribeEndpointsCacheMinutes int64 `json:"describe_endpoints_cache_minutes"`
+    ConnectionTracing bool `json:"connection_tracing"`
+    RewriteLogInterval time.Duration `json:"rewrite_log_interval_ns"`
+    UnixSocket string `json:"unix_socket"`
+    LocalAddr string `json:"local_addr"`
+    DialTimeout time.Duration `json:"dial_timeout_ns"`
+    TCPKeepAlive time.Duration `json:"tcp_keepalive_ns"`
+    ResponseHeaderTimeout time.Duration `json:"response_header_timeout_ns"`
+    CustomProxy bool `json:"custom_proxy"`
+    NoProxy []string `json:"no_proxy"`
+    ClientCertificateProvider bool `json:"client_certificate_provider"`
+    ClientCertificateCacheTTL time.Duration `json:"client_certificate_cache_ttl_ns"`
+    ValidateClientCert bool `json:"validate_client_cert"`
+    ClientCertCA bool `json:"client_cert_ca"`
+    TLSSessionCache bool `json:"tls_session_cache"`
+    LocalNodesTLSConfig bool `json:"localnodes_tls_config"`
+    LocalNodesIgnoreCertError bool `json:"localnodes_ignore_cert_error"`
+    HostHeaderRealNode bool `json:"host_header_real_node"`
+    Anonymous bool `json:"anonymous"`
+    RequestSigner bool `json:"request_signer"`
+}
+
+// effective_config() returns the configuration this object is using.
+func (this *AlternatorNodes) effective_config() ConfigSnapshot {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    ret := ConfigSnapshot{
+        Scheme: this.scheme,
+        Port: this.port_for(this.scheme),
+        PortCandidates: append([]int(nil), this.port_candidates...),
+        SchemeAutoDetect: this.scheme_auto_detect,
+        Seeds: append([]string(nil), this.seeds...),
+        Rack: this.rack,
+        Datacenter: this.datacenter,
+        RackParam: this.rack_param,
+        DatacenterParam: this.datacenter_param,
+        UserAgent: this.user_agent,
+        UpdatePeriod: update_period,
+        TopologyDiscovery: !this.disable_topology_discovery,
+        RefreshOnlyOnRequest: this.refresh_only_on_request,
+        MaxTopologyStaleness: this.max_staleness,
+        UpdateRetries: this.update_retries,
+        UpdateBackoff: this.update_backoff,
+        UpdateDeadline: this.update_deadline,
+        WarmConnectionsOnUpdate: this.warm_on_update,
+        NodeSubsetSize: this.subset_size,
+        ClientID: this.client_id,
+        LatencyAwareRouting: this.latency_aware,
+        SeedFallback: !this.disable_seed_fallback,
+        SeedFallbackWarning: this.seed_fallback_threshold,
+        SeedFallbackCallback: this.seed_fallback_callback != nil,
+        WarnOnSeedMismatch: this.warn_on_seed_mismatch,
+        FollowLocalNodesRedirects: this.follow_localnodes_redirects,
+        NodeAddressMapper: this.node_address_mapper != nil,
+        NodeEqualFunc: this.node_equal != nil,
+        DNSCacheTTL: this.dns_cache_ttl,
+        RetryDifferentNode: this.retry_different_node,
+        RetryableErrorFunc: this.node_error != nil,
+        CustomContext: this.parent_ctx != context.Background(),
+        StickyControlPlaneNode: this.sticky_update_node,
+        HealthMinNodes: this.health_min_nodes,
+        HealthMaxStaleness: this.health_max_staleness,
+        ClockSkewDetection: this.clock_skew_detection,
+        PerNodeRateLimit: this.rate_limit,
+        InitialCursor: this.initial_cursor,
+        PreserveServerOrder: this.preserve_server_order,
+        PreferredNodes: append([]string(nil), this.preferred...),
+        SelectionStride: this.stride,
+        SpreadParallelScan: this.spread_parallel_scan,
+        AllowEmptyNodeList: this.allow_empty_node_list,
+        SecondarySeeds: append([]string(nil), this.secondary_seeds...),
+        CloseConnectionsOnTopologyChange: this.close_on_topology_change,
+        CredentialsFile: this.credentials_file,
+        RequireCredentials: this.require_credentials,
+        DescribeEndpointsCacheMinutes: this.describe_endpoints_cache_minutes,
+        ConnectionTracing: this.connection_tracing,
+        RewriteLogInterval: this.rewrite_log_interval,
+        UnixSocket: this.unix_socket,
+        DialTimeout: this.dial_timeout,
+        TCPKeepAlive: this.tcp_keepalive,
+        ResponseHeaderTimeout: this.response_header_timeout,
+        CustomProxy: this.proxy != nil,
+        NoProxy: append([]string(nil), this.no_proxy...),
+        ClientCertificateProvider: this.client_cert_provider != nil,
+        ClientCertificateCacheTTL: this.client_cert_cache_ttl,
+        ValidateClientCert: this.validate_client_cert,
+        ClientCertCA: this.client_cert_ca != nil,
+        TLSSessionCache: this.tls_session_cache != nil,
+        LocalNodesTLSConfig: this.localnodes_tls_config != nil,
+        LocalNodesIgnoreCertError: this.localnodes_ignore_cert_error,
+        HostHeaderRealNode: this.host_header_strategy == HostHeaderRealNode,
+        Anonymous: this.anonymous,
+        RequestSigner: this.request_signer != nil,
+    }
+    if this.local_addr != nil {
+        ret.LocalAddr = this.local_addr.String()
+    }
+    if len(this.scheme_ports) > 0 {
+        ret.PortForScheme = make(map[string]int)
+        for scheme, port := range this.scheme_ports {
+            ret.PortForScheme[scheme] = port
+        }
+    }
+    return ret
+}
@@ -0,0 +1,71 @@
+// A ready-made HTTP health check handler, for applications which expose
+// their own "/healthz" or "/readyz" endpoint. See health_handler().
+
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+)
+
+// WithHealthMinNodes() sets how many nodes health_handler() requires to
+// report healthy, by default 1.
+func WithHealthMinNodes(n int) Option {
+    return func(this *AlternatorNodes) {
+        this.health_min_nodes = n
+    }
+}
+
+// WithHealthMaxStaleness() makes health_handler() report unhealthy when the
+// list of nodes was last fetched successfully longer ago than this. Zero
+// (the default) doesn't check the age of the list.
+func WithHealthMaxStaleness(staleness time.Duration) Option {
+    return func(this *AlternatorNodes) {
+        this.health_max_staleness = staleness
+    }
+}
+
+// HealthStatus is the JSON body of health_handler()'s responses.
+type HealthStatus struct {
+    Healthy bool `json:"healthy"`
+    Reason string `json:"reason,omitempty"`
+    Nodes []string `json:"nodes"`
+    // The age of the list of nodes, or -1 if it was never fetched.
+    Age time.Duration `json:"age_ns"`
+}
+
+// health_status() checks whether we know enough live nodes, with a recent
+// enough list, see health_handler().
+func (this *AlternatorNodes) health_status() HealthStatus {
+    ret := HealthStatus{Healthy: true, Nodes: this.current_nodes(), Age: -1}
+    if last_good := this.last_good.Load(); last_good != nil {
+        ret.Age = time.Since(last_good.time)
+    }
+    discovery := !this.disable_topology_discovery
+    switch {
+    case discovery && this.is_using_seed_fallback():
+        ret.Healthy, ret.Reason = false, "no list of live nodes yet"
+    case len(ret.Nodes) < this.health_min_nodes:
+        ret.Healthy, ret.Reason = false, "too few nodes"
+    case discovery && this.health_max_staleness > 0 && ret.Age > this.health_max_staleness:
+        ret.Healthy, ret.Reason = false, "list of nodes is stale"
+    }
+    return ret
+}
+
+// health_handler() returns an http.Handler for an application's health
+// check endpoint. It responds with 200 if we know at least the minimum
+// number of live nodes (see WithHealthMinNodes()), and their list is not
+// stale (see WithHealthMaxStaleness()), and with 503 otherwise. The body
+// is a JSON HealthStatus.
+func (this *AlternatorNodes) health_handler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        status := this.health_status()
+        w.Header().Set("Content-Type", "application/json")
+        if !status.Healthy {
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }
+        json.NewEncoder(w).Encode(status)
+    })
+}
@@ -0,0 +1,411 @@
+// Per-node statistics of the requests sent through a session created by
+// AlternatorNodes.session(), for dashboards and for diagnosing a node
+// which misbehaves.
+
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/aws/request"
+    "context"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "math/rand"
+    "net"
+    "net/http/httptrace"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// The statistics cover the last one to two windows of this length, so old
+// errors age out.
+const node_stats_window = 1*time.Minute
+
+// NodeStat holds the statistics of one node, as returned by node_stats().
+// Requests and Errors count request attempts in the recent window (between
+// one and two node_stats_window long). Errors only counts failures which
+// are likely the node's fault (see is_node_error()), not errors such as a
+// failed condition, which the node reported correctly.
+//
+// OpenConnections is the number of connections currently open to the node.
+// It is only tracked with WithConnectionTracing().
+//
+// TLSHandshakes counts all TLS handshakes with the node since startup, and
+// TLSResumed those which resumed a previous session instead of doing a
+// full handshake. They are only tracked with WithTLSSessionCache().
+//
+// Latency is a moving average of the time requests to the node took, from
+// sending the request until the response arrived. Requests which failed
+// because of the node are not included. Zero means there is no
+// measurement yet.
+//
+// Throttled counts the times since startup the node was skipped because it
+// was over its WithPerNodeRateLimit() limit.
+//
+// NodeStat, and the map returned by node_stats(), can be marshaled to JSON
+// as is. Latency is then in nanoseconds ("latency_ns").
+//
+// With WithSecondaryNodes(), the statistics of the secondary cluster's
+// nodes are kept by the secondary AlternatorNodes object - so its latency
+// aware routing and rate limiting work after a failover - and node_stats()
+// reports the nodes of both clusters.
+type NodeStat struct {
+    Requests uint64 `json:"requests"`
+    Errors uint64 `json:"errors"`
+    LastError time.Time `json:"last_error"`
+    OpenConnections int64 `json:"open_connections"`
+    TLSHandshakes uint64 `json:"tls_handshakes"`
+    TLSResumed uint64 `json:"tls_resumed"`
+    Latency time.Duration `json:"latency_ns"`
+    Throttled uint64 `json:"throttled"`
+}
+
+// The weight of each new measurement in the moving average of a node's
+// latency. With 0.2, a node's latency follows a change within about ten
+// requests.
+const latency_ewma_weight = 0.2
+
+// node_counters holds the statistics of one node, in two windows: the
+// current one, and the previous one.
+type node_counters struct {
+    open_connections atomic.Int64
+    tls_handshakes atomic.Uint64
+    tls_resumed atomic.Uint64
+    throttled atomic.Uint64
+    selected atomic.Uint64
+    mutex sync.Mutex
+    window_start time.Time
+    current NodeStat
+    previous NodeStat
+    latency time.Duration
+    // The token bucket of WithPerNodeRateLimit().
+    tokens float64
+    bucket_time time.Time
+}
+
+// rotate() moves to a new window, if the current one is over. Must be
+// called with the mutex held.
+func (c *node_counters) rotate(now time.Time) {
+    elapsed := now.Sub(c.window_start)
+    if elapsed < node_stats_window {
+        return
+    }
+    if elapsed < 2*node_stats_window {
+        c.previous = c.current
+    } else {
+        c.previous = NodeStat{LastError: c.current.LastError}
+    }
+    c.current = NodeStat{LastError: c.current.LastError}
+    c.window_start = now
+}
+
+func (c *node_counters) record(failed bool) {
+    now := time.Now()
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.rotate(now)
+    c.current.Requests++
+    if failed {
+        c.current.Errors++
+        c.current.LastError = now
+    }
+}
+
+func (c *node_counters) record_latency(d time.Duration) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if c.latency == 0 {
+        c.latency = d
+    } else {
+        c.latency += time.Duration(latency_ewma_weight * float64(d - c.latency))
+    }
+}
+
+func (c *node_counters) get_latency() time.Duration {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return c.latency
+}
+
+func (c *node_counters) get() NodeStat {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.rotate(time.Now())
+    return NodeStat{
+        Requests: c.previous.Requests + c.current.Requests,
+        Errors: c.previous.Errors + c.current.Errors,
+        LastError: c.current.LastError,
+        OpenConnections: c.open_connections.Load(),
+        TLSHandshakes: c.tls_handshakes.Load(),
+        TLSResumed: c.tls_resumed.Load(),
+        Latency: c.latency,
+        Throttled: c.throttled.Load(),
+    }
+}
+
+// add() adds the statistics of the same node kept elsewhere, see
+// node_stats().
+func (s *NodeStat) add(other NodeStat) {
+    s.Requests += other.Requests
+    s.Errors += other.Errors
+    if other.LastError.After(s.LastError) {
+        s.LastError = other.LastError
+    }
+    s.OpenConnections += other.OpenConnections
+    s.TLSHandshakes += other.TLSHandshakes
+    s.TLSResumed += other.TLSResumed
+    if s.Latency == 0 {
+        s.Latency = other.Latency
+    }
+    s.Throttled += other.Throttled
+}
+
+// served_by_key is the context key under which route() records which
+// cluster - this object or its WithSecondaryNodes() - a request was sent
+// to, when there is a secondary cluster.
+type served_by_key struct{}
+
+// served_by() returns the AlternatorNodes object whose node the request was
+// sent to, which keeps the statistics of that node.
+func (this *AlternatorNodes) served_by(r *request.Request) *AlternatorNodes {
+    if nodes, ok := r.Context().Value(served_by_key{}).(*AlternatorNodes); ok {
+        return nodes
+    }
+    return this
+}
+
+// counters() returns the counters of the given node ("host:port"),
+// creating them if needed.
+func (this *AlternatorNodes) counters(node string) *node_counters {
+    if c, ok := this.stats.Load(node); ok {
+        return c.(*node_counters)
+    }
+    c, _ := this.stats.LoadOrStore(node, &node_counters{window_start: time.Now()})
+    return c.(*node_counters)
+}
+
+// is_node_error() is the default classification of a request's error, see
+// WithRetryableErrorFunc(). Failing to get a response at all, or getting an
+// HTTP 5xx response, is the node's fault, and another node may succeed.
+// Any other error response - e.g., ConditionalCheckFailedException, or
+// ProvisionedThroughputExceededException - was correctly reported by the
+// node, and another node would return the same. A request canceled by the
+// application is nobody's fault.
+func is_node_error(err error) bool {
+    if err == nil {
+        return false
+    }
+    // A NodeError passes on the status of the error it wraps, or 0.
+    var nerr *NodeError
+    if errors.As(err, &nerr) {
+        err = nerr.Err
+    }
+    var failure awserr.RequestFailure
+    if errors.As(err, &failure) {
+        return failure.StatusCode() >= 500
+    }
+    var aerr awserr.Error
+    if errors.As(err, &aerr) && aerr.Code() == request.CanceledErrorCode {
+        return false
+    }
+    return true
+}
+
+// WithRetryableErrorFunc() replaces is_node_error(), which decides whether
+// a request failed because of the node it was sent to - so the node is
+// counted as failing in node_stats(), and retrying the request on another
+// node may help - or because of the request itself.
+func WithRetryableErrorFunc(f func(error) bool) Option {
+    return func(this *AlternatorNodes) {
+        this.node_error = f
+    }
+}
+
+// record_attempt() is a CompleteAttempt handler, which records the outcome
+// of each attempt to send a request to a node.
+func (this *AlternatorNodes) record_attempt(r *request.Request) {
+    if errors.Is(r.Error, ErrNoNodes) {
+        // Not sent to any node.
+        return
+    }
+    c := this.served_by(r).counters(r.HTTPRequest.URL.Host)
+    failed := this.node_error(r.Error)
+    c.record(failed)
+    if !failed && r.HTTPResponse != nil {
+        c.record_latency(time.Since(r.AttemptTime))
+    }
+}
+
+// node_stats() returns the recent statistics of each node ("host:port") to
+// which requests were sent.
+func (this *AlternatorNodes) node_stats() map[string]NodeStat {
+    ret := make(map[string]NodeStat)
+    this.stats.Range(func(node, c any) bool {
+        ret[node.(string)] = c.(*node_counters).get()
+        return true
+    })
+    if this.secondary != nil {
+        // The connections to the secondary's nodes are counted here, as
+        // the sessions' transports are ours.
+        for node, stat := range this.secondary.node_stats() {
+            stat.add(ret[node])
+            ret[node] = stat
+        }
+    }
+    return ret
+}
+
+// selection_histogram() returns how many times each node ("host:port") was
+// picked for a request since startup, or since reset_selection_stats(). It
+// is meant for checking, e.g., in tests and benchmarks, that the load is
+// spread as intended. Unlike node_stats(), it counts all selections, not
+// just those in the recent window, and it doesn't count requests sent to
+// a node given with ContextWithNode(), as these weren't balanced.
+func (this *AlternatorNodes) selection_histogram() map[string]uint64 {
+    ret := make(map[string]uint64)
+    this.stats.Range(func(node, c any) bool {
+        if n := c.(*node_counters).selected.Load(); n > 0 {
+            ret[node.(string)] = n
+        }
+        return true
+    })
+    if this.secondary != nil {
+        for node, n := range this.secondary.selection_histogram() {
+            ret[node] += n
+        }
+    }
+    return ret
+}
+
+// reset_selection_stats() sets all the counts of selection_histogram() back
+// to zero.
+func (this *AlternatorNodes) reset_selection_stats() {
+    this.stats.Range(func(node, c any) bool {
+        c.(*node_counters).selected.Store(0)
+        return true
+    })
+    if this.secondary != nil {
+        this.secondary.reset_selection_stats()
+    }
+}
+
+// WithConnectionTracing() makes node_stats() also report how many
+// connections are currently open to each node. Go's HTTP transport doesn't
+// expose this, so we count the connections as they are opened and closed,
+// which adds a small overhead to each new connection. It is therefore off
+// by default. Note that when a proxy is used, connections are counted for
+// the proxy, not for the nodes behind it.
+func WithConnectionTracing(enabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.connection_tracing = enabled
+    }
+}
+
+// count_connections() wraps a transport's DialContext function, to count
+// the open connections to each address.
+func (this *AlternatorNodes) count_connections(
+        dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+    return func(ctx context.Context, network, addr string) (net.Conn, error) {
+        conn, err := dial(ctx, network, addr)
+        if err != nil {
+            return nil, err
+        }
+        c := this.counters(addr)
+        c.open_connections.Add(1)
+        return &counted_conn{Conn: conn, counters: c}, nil
+    }
+}
+
+// counted_conn is a connection counted in its node's open_connections.
+type counted_conn struct {
+    net.Conn
+    counters *node_counters
+    close_once sync.Once
+}
+
+func (c *counted_conn) Close() error {
+    c.close_once.Do(func() {
+        c.counters.open_connections.Add(-1)
+    })
+    return c.Conn.Close()
+}
+
+// trace_tls() is a Send handler, which counts the TLS handshakes, and
+// resumed sessions, of the connection opened for the request, if one is.
+// It is a handler rather than a wrapper of the session's transport, as the
+// SDK needs that to be a plain *http.Transport (see new_session()).
+func (this *AlternatorNodes) trace_tls(r *request.Request) {
+    c := this.served_by(r).counters(r.HTTPRequest.URL.Host)
+    trace := &httptrace.ClientTrace{
+        TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+            if err == nil {
+                c.tls_handshakes.Add(1)
+                if state.DidResume {
+                    c.tls_resumed.Add(1)
+                }
+            }
+        },
+    }
+    // Based on r.Context(), not on the HTTP request's context, so the
+    // trace of a previous attempt isn't kept.
+    r.HTTPRequest = r.HTTPRequest.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+// The share of requests which latency-aware routing sends in the usual
+// round-robin order, so every node keeps getting some requests, and a node
+// which was slow for a while gets its share back once it recovers.
+const latency_exploration = 0.1
+
+// WithLatencyAwareRouting() sends more requests to the nodes which have been
+// answering faster: each node is picked with a probability inversely
+// proportional to its average latency, as reported by node_stats(). Nodes
+// without a measurement yet are treated like the fastest node. A tenth of
+// the requests still go to all nodes in turn, so the measurements of slow
+// nodes stay up to date. preview_selection() ignores this option.
+func WithLatencyAwareRouting(enabled bool) Option {
+    return func(this *AlternatorNodes) {
+        this.latency_aware = enabled
+    }
+}
+
+// pick_by_latency() picks a live node at random, weighted by the inverse of
+// its latency, see WithLatencyAwareRouting(). It returns false when the
+// request should use the round-robin order instead. Must be called with
+// the mutex held.
+func (this *AlternatorNodes) pick_by_latency() (string, bool) {
+    if len(this.nodes) < 2 || rand.Float64() < latency_exploration {
+        return "", false
+    }
+    latencies := make([]time.Duration, len(this.nodes))
+    fastest := time.Duration(0)
+    for i, node := range this.nodes {
+        if c, ok := this.stats.Load(fmt.Sprintf("%s:%d", node, this.port_for(this.scheme))); ok {
+            latencies[i] = c.(*node_counters).get_latency()
+        }
+        if latencies[i] > 0 && (fastest == 0 || latencies[i] < fastest) {
+            fastest = latencies[i]
+        }
+    }
+    if fastest == 0 {
+        return "", false
+    }
+    weights := make([]float64, len(this.nodes))
+    total := 0.0
+    for i, latency := range latencies {
+        if latency == 0 {
+            latency = fastest
+        }
+        weights[i] = 1 / float64(latency)
+        total += weights[i]
+    }
+    x := rand.Float64() * total
+    for i, w := range weights {
+        if x < w {
+            return this.nodes[i], true
+        }
+        x -= w
+    }
+    return this.nodes[len(this.nodes)-1], true
+}
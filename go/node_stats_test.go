@@ -0,0 +1,214 @@
+package main
+
+import (
+    "github.com/aws/aws-sdk-go/aws/awserr"
+    "github.com/aws/aws-sdk-go/aws/request"
+    "github.com/aws/aws-sdk-go/service/dynamodb"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/json"
+    "errors"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestTLSSessionCacheStats(t *testing.T) {
+    port := new_tls_test_server(t, answer_dynamodb)
+    nodes := NewAlternatorNodes("https", port, []string{"127.0.0.1"},
+        WithStaticNodes([]string{"127.0.0.1"}), WithTLSSessionCache(tls.NewLRUClientSessionCache(0)))
+    defer nodes.stop()
+    // The SDK can only apply AWS_CA_BUNDLE to a plain *http.Transport.
+    sess, err := nodes.new_session("dog.scylladb.com", "alternator", "secret_pass")
+    if err != nil {
+        t.Fatal(err)
+    }
+    db := dynamodb.New(sess)
+    for i := 0; i < 2; i++ {
+        if _, err := db.DescribeEndpoints(&dynamodb.DescribeEndpointsInput{}); err != nil {
+            t.Fatal(err)
+        }
+        // Force a new connection, which can resume the TLS session.
+        nodes.close_idle_connections()
+    }
+    stat := nodes.node_stats()["127.0.0.1:" + strconv.Itoa(port)]
+    if stat.TLSHandshakes != 2 || stat.TLSResumed != 1 {
+        t.Errorf("got %d handshakes, %d resumed, expected 2 and 1", stat.TLSHandshakes, stat.TLSResumed)
+    }
+}
+
+func TestNodeStatsAfterFailover(t *testing.T) {
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/localnodes" {
+            // The primary cluster's only node is down.
+            w.WriteHeader(http.StatusInternalServerError)
+            return
+        }
+        answer_dynamodb(w, r)
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.9"},
+        WithRefreshOnlyOnRequest(true), WithUpdateRetries(0),
+        WithSecondaryNodes([]string{"127.0.0.2"}, WithStaticNodes([]string{"127.0.0.2"})))
+    defer nodes.stop()
+    nodes.mutex.Lock()
+    nodes.seed_fallback_since = time.Now().Add(-time.Hour)
+    nodes.mutex.Unlock()
+    if cluster := nodes.active_cluster(); cluster != "secondary" {
+        t.Fatalf("active cluster is %s", cluster)
+    }
+    db := dynamodb.New(nodes.session("dog.scylladb.com", "alternator", "secret_pass"))
+    for i := 0; i < 3; i++ {
+        if _, err := db.DescribeEndpoints(&dynamodb.DescribeEndpointsInput{}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    node := "127.0.0.2:" + strconv.Itoa(port)
+    // The secondary, which picks the nodes, has their statistics...
+    if stat := nodes.secondary.node_stats()[node]; stat.Requests != 3 || stat.Latency == 0 {
+        t.Errorf("secondary's statistics of %s: %+v", node, stat)
+    }
+    // ...and the primary reports them too.
+    if stat := nodes.node_stats()[node]; stat.Requests != 3 {
+        t.Errorf("primary's statistics of %s: %+v", node, stat)
+    }
+    if n := nodes.selection_histogram()[node]; n != 3 {
+        t.Errorf("%s was selected %d times", node, n)
+    }
+}
+
+func TestIsNodeError(t *testing.T) {
+    failure := func(code string, status int) error {
+        return awserr.NewRequestFailure(awserr.New(code, "message", nil), status, "request-id")
+    }
+    for _, c := range []struct {
+        name string
+        err error
+        expected bool
+    }{
+        {"no error", nil, false},
+        {"ConditionalCheckFailedException", failure(dynamodb.ErrCodeConditionalCheckFailedException, 400), false},
+        {"ProvisionedThroughputExceededException", failure(dynamodb.ErrCodeProvisionedThroughputExceededException, 400), false},
+        {"ResourceNotFoundException", failure(dynamodb.ErrCodeResourceNotFoundException, 400), false},
+        {"ValidationException", failure("ValidationException", 400), false},
+        {"InternalServerError", failure(dynamodb.ErrCodeInternalServerError, 500), true},
+        {"ServiceUnavailable", failure("ServiceUnavailable", 503), true},
+        {"connection error", awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection refused")), true},
+        {"canceled", awserr.New(request.CanceledErrorCode, "request context canceled", errors.New("context canceled")), false},
+        {"NodeError with 500", &NodeError{Node: "127.0.0.1:8000", Err: failure(dynamodb.ErrCodeInternalServerError, 500)}, true},
+        {"NodeError with 400", &NodeError{Node: "127.0.0.1:8000", Err: failure(dynamodb.ErrCodeConditionalCheckFailedException, 400)}, false},
+    } {
+        if got := is_node_error(c.err); got != c.expected {
+            t.Errorf("%s: got %v, expected %v", c.name, got, c.expected)
+        }
+    }
+}
+
+// marshal() marshals v to JSON, and unmarshals it into a map, to check the
+// names and types of the fields.
+func marshal(t *testing.T, v interface{}) (string, map[string]interface{}) {
+    t.Helper()
+    b, err := json.Marshal(v)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var ret map[string]interface{}
+    if err := json.Unmarshal(b, &ret); err != nil {
+        t.Fatal(err)
+    }
+    return string(b), ret
+}
+
+func TestNodeStatAndConfigJSON(t *testing.T) {
+    _, stat := marshal(t, NodeStat{Requests: 3, Errors: 1, Latency: 2*time.Millisecond})
+    if stat["requests"] != 3.0 || stat["errors"] != 1.0 || stat["latency_ns"] != 2e6 {
+        t.Errorf("NodeStat marshaled to %v", stat)
+    }
+    if _, ok := stat["last_error"].(string); !ok {
+        t.Errorf("last_error is not a string: %v", stat["last_error"])
+    }
+
+    nodes := NewAlternatorNodes("http", 8000, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true),
+        WithLocalAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}), WithUserAgent("my-app"))
+    defer nodes.stop()
+    // The credentials go to the session, never to the configuration.
+    nodes.session("dog.scylladb.com", "alternator", "secret_pass")
+    text, config := marshal(t, nodes.effective_config())
+    if config["scheme"] != "http" || config["port"] != 8000.0 || config["user_agent"] != "my-app" ||
+            config["update_period_ns"] != float64(update_period) {
+        t.Errorf("ConfigSnapshot marshaled to %s", text)
+    }
+    if seeds, ok := config["seeds"].([]interface{}); !ok || len(seeds) != 1 || seeds[0] != "127.0.0.1" {
+        t.Errorf("seeds marshaled to %v", config["seeds"])
+    }
+    if config["local_addr"] != "127.0.0.1:0" {
+        t.Errorf("local_addr marshaled to %v", config["local_addr"])
+    }
+    if strings.Contains(text, "secret_pass") {
+        t.Errorf("the secret key appears in %s", text)
+    }
+    for key := range config {
+        for _, secret := range []string{"secret", "password", "token"} {
+            if strings.Contains(key, secret) {
+                t.Errorf("ConfigSnapshot has a field %s", key)
+            }
+        }
+    }
+}
+
+func TestEffectiveConfigReportsOptions(t *testing.T) {
+    // Without a certificate provider, WithValidateClientCert() makes
+    // NewAlternatorNodes() print a configuration error, which doesn't
+    // matter here.
+    nodes := NewAlternatorNodes("http", 8000, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true),
+        WithPortForScheme(map[string]int{"https": 8043}), WithSchemeAutoDetect(true),
+        WithSpreadParallelScan(true), WithSelectionStride(3), WithWarnOnSeedMismatch(true),
+        WithConnectionTracing(true), WithPreferredNodes([]string{"127.0.0.2"}),
+        WithRewriteLogInterval(time.Minute), WithFollowLocalNodesRedirects(true),
+        WithDescribeEndpointsCacheMinutes(2), WithSeedFallbackWarning(time.Hour, nil),
+        WithValidateClientCert(true), WithClientCertCA(x509.NewCertPool()))
+    defer nodes.stop()
+    text, config := marshal(t, nodes.effective_config())
+    for key, expected := range map[string]interface{}{
+        "scheme_auto_detect": true,
+        "spread_parallel_scan": true,
+        "selection_stride": 3.0,
+        "warn_on_seed_mismatch": true,
+        "connection_tracing": true,
+        "rewrite_log_interval_ns": float64(time.Minute),
+        "follow_localnodes_redirects": true,
+        "describe_endpoints_cache_minutes": 2.0,
+        "seed_fallback_warning_ns": float64(time.Hour),
+        "seed_fallback_callback": false,
+        "validate_client_cert": true,
+        "client_cert_ca": true,
+    } {
+        if config[key] != expected {
+            t.Errorf("%s is %v, expected %v", key, config[key], expected)
+        }
+    }
+    if ports, ok := config["port_for_scheme"].(map[string]interface{}); !ok || ports["https"] != 8043.0 {
+        t.Errorf("ConfigSnapshot marshaled to %s", text)
+    }
+    if preferred, ok := config["preferred_nodes"].([]interface{}); !ok || len(preferred) != 1 || preferred[0] != "127.0.0.2" {
+        t.Errorf("preferred_nodes marshaled to %v", config["preferred_nodes"])
+    }
+}
+
+func TestHealthStatusJSON(t *testing.T) {
+    nodes := NewAlternatorNodes("http", 8000, []string{"10.0.0.1"},
+        WithStaticNodes([]string{"10.0.0.2", "10.0.0.3"}))
+    defer nodes.stop()
+    text, status := marshal(t, nodes.health_status())
+    if status["healthy"] != true || status["age_ns"] == nil {
+        t.Errorf("HealthStatus marshaled to %s", text)
+    }
+    if _, ok := status["reason"]; ok {
+        t.Errorf("a healthy status has a reason: %s", text)
+    }
+    if a, ok := status["nodes"].([]interface{}); !ok || len(a) != 2 || a[0] != "10.0.0.2" {
+        t.Errorf("nodes marshaled to %v", status["nodes"])
+    }
+}
@@ -0,0 +1,67 @@
+// Client-side limiting of the request rate to each node, so a client doesn't
+// overload a single (e.g., smaller) node. See WithPerNodeRateLimit().
+
+package main
+
+import (
+    "time"
+)
+
+// WithPerNodeRateLimit() limits the requests this client sends to each node
+// to about rps per second, with a token bucket per node allowing bursts of
+// up to rps requests. A request whose node is over its limit goes to the
+// next node instead; if all nodes are over their limit, it goes to the one
+// closest to being under it, rather than waiting. The number of times a
+// node was skipped is reported as Throttled by node_stats(). Zero (the
+// default) means no limit.
+func WithPerNodeRateLimit(rps int) Option {
+    return func(this *AlternatorNodes) {
+        this.rate_limit = rps
+    }
+}
+
+// take_token() takes a token from the node's bucket, refilling it first at
+// rps tokens per second. It returns false, and the number of tokens left,
+// if there is no whole token.
+func (c *node_counters) take_token(rps int, now time.Time) (bool, float64) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if c.bucket_time.IsZero() {
+        c.tokens = float64(rps)
+    } else {
+        c.tokens += now.Sub(c.bucket_time).Seconds() * float64(rps)
+        if c.tokens > float64(rps) {
+            c.tokens = float64(rps)
+        }
+    }
+    c.bucket_time = now
+    if c.tokens < 1 {
+        return false, c.tokens
+    }
+    c.tokens--
+    return true, c.tokens
+}
+
+// rate_limit_node() returns the given node picked for a request, if it's
+// under its rate limit, and otherwise the next node in turn which is, see
+// WithPerNodeRateLimit().
+func (this *AlternatorNodes) rate_limit_node(node string) string {
+    now := time.Now()
+    best, best_tokens := node, -1.0
+    n := len(this.current_nodes())
+    for i := 0; ; i++ {
+        c := this.counters(this.node_url(node).Host)
+        ok, tokens := c.take_token(this.rate_limit, now)
+        if ok {
+            return node
+        }
+        c.throttled.Add(1)
+        if tokens > best_tokens {
+            best, best_tokens = node, tokens
+        }
+        if i + 1 >= n {
+            return best
+        }
+        node = this.pickone()
+    }
+}
@@ -0,0 +1,90 @@
+// Client-side subsetting: in a large cluster, each client sends its
+// requests to only a small, stable subset of the nodes, instead of opening
+// connections to all of them. See WithNodeSubsetSize().
+
+package main
+
+import (
+    "fmt"
+    "hash/fnv"
+    "os"
+    "sort"
+)
+
+// WithNodeSubsetSize() limits the nodes this client sends requests to, to
+// n of the live nodes. Each client picks a different subset, based on its
+// client ID, so the load is still spread evenly over the cluster when there
+// are many clients - while each client needs far fewer connections. Zero
+// (the default) disables subsetting.
+func WithNodeSubsetSize(n int) Option {
+    return func(this *AlternatorNodes) {
+        this.subset_size = n
+    }
+}
+
+// WithClientID() sets the ID identifying this client for subsetting (see
+// WithNodeSubsetSize()), instead of the default host name and process ID.
+// A stable ID, e.g., the name of the pod, keeps the client's subset the same
+// across restarts, and clients with different IDs pick different, but
+// overlapping, subsets.
+func WithClientID(id string) Option {
+    return func(this *AlternatorNodes) {
+        this.client_id = id
+    }
+}
+
+// default_client_id() is the client ID used for subsetting, unless one is
+// given: the host name and process ID, which are different for each client.
+func default_client_id() string {
+    host, _ := os.Hostname()
+    return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// subset() returns the subset of the given nodes this client should use,
+// see WithNodeSubsetSize(). It uses rendezvous hashing: every node gets a
+// score by hashing it together with the client ID, and the n nodes with
+// the highest scores are chosen. So each client picks an independent,
+// random-looking subset, and when a node is added or removed, each client's
+// subset changes by at most that one node. The result keeps the order of
+// the list it was chosen from - sorted, unless WithPreserveServerOrder().
+func (this *AlternatorNodes) subset(nodes []string) []string {
+    if this.subset_size <= 0 || len(nodes) <= this.subset_size {
+        return nodes
+    }
+    scores := make(map[string]uint64, len(nodes))
+    for _, node := range nodes {
+        h := fnv.New64a()
+        h.Write([]byte(this.client_id))
+        h.Write([]byte{0})
+        h.Write([]byte(node))
+        scores[node] = mix64(h.Sum64())
+    }
+    ret := append([]string(nil), nodes...)
+    sort.Slice(ret, func(i, j int) bool {
+        return scores[ret[i]] > scores[ret[j]]
+    })
+    chosen := make(map[string]bool, this.subset_size)
+    for _, node := range ret[:this.subset_size] {
+        chosen[node] = true
+    }
+    ret = ret[:0]
+    for _, node := range nodes {
+        if chosen[node] {
+            ret = append(ret, node)
+        }
+    }
+    return ret
+}
+
+// mix64() is the splitmix64 finalizer. FNV alone spreads node names which
+// differ only in their last characters (like consecutive IP addresses)
+// poorly, and without this some nodes would be in twice as many subsets
+// as others.
+func mix64(x uint64) uint64 {
+    x ^= x >> 30
+    x *= 0xbf58476d1ce4e5b9
+    x ^= x >> 27
+    x *= 0x94d049bb133111eb
+    x ^= x >> 31
+    return x
+}
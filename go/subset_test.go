@@ -0,0 +1,103 @@
+package main
+
+import (
+    "net/http"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// test_nodes() returns n node addresses, in sorted order like the lists
+// returned by fetch_nodes().
+func test_nodes(n int) []string {
+    var ret []string
+    for i := 0; i < n; i++ {
+        ret = append(ret, "10.0." + strconv.Itoa(i / 100) + "." + strconv.Itoa(100 + i % 100))
+    }
+    return ret
+}
+
+func TestSubsetEvenAcrossClients(t *testing.T) {
+    nodes := test_nodes(50)
+    clients := 1000
+    count := map[string]int{}
+    for i := 0; i < clients; i++ {
+        this := &AlternatorNodes{subset_size: 5, client_id: "client-" + strconv.Itoa(i)}
+        subset := this.subset(nodes)
+        if len(subset) != 5 {
+            t.Fatalf("got a subset of %d nodes, expected 5", len(subset))
+        }
+        for _, node := range subset {
+            count[node]++
+        }
+    }
+    // Each node is expected in 1000*5/50 = 100 subsets.
+    for _, node := range nodes {
+        if count[node] < 60 || count[node] > 140 {
+            t.Errorf("%s is in %d subsets, expected about 100", node, count[node])
+        }
+    }
+}
+
+func TestSubsetChurnOnNodeRemoval(t *testing.T) {
+    nodes := test_nodes(50)
+    removed := nodes[17]
+    remaining := append(append([]string(nil), nodes[:17]...), nodes[18:]...)
+    clients := 1000
+    changed := 0
+    for i := 0; i < clients; i++ {
+        this := &AlternatorNodes{subset_size: 5, client_id: "client-" + strconv.Itoa(i)}
+        before := this.subset(nodes)
+        after := this.subset(remaining)
+        had_removed := false
+        for _, node := range before {
+            if node == removed {
+                had_removed = true
+            }
+        }
+        // Only the removed node may be replaced, by one other node.
+        kept := 0
+        for _, node := range after {
+            for _, old := range before {
+                if node == old {
+                    kept++
+                }
+            }
+        }
+        if had_removed {
+            changed++
+            if kept != 4 {
+                t.Errorf("client %d kept %d of its nodes, expected 4", i, kept)
+            }
+        } else if kept != 5 {
+            t.Errorf("client %d without the removed node kept %d of its nodes", i, kept)
+        }
+    }
+    // About 1000*5/50 = 100 clients had the removed node.
+    if changed < 60 || changed > 140 {
+        t.Errorf("%d clients had to change their subset, expected about 100", changed)
+    }
+}
+
+func TestSeedMismatchCheckedBeforeSubset(t *testing.T) {
+    port := new_test_server(t, func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte(`["127.0.0.1","127.0.0.2","127.0.0.3","127.0.0.4"]`))
+    })
+    nodes := NewAlternatorNodes("http", port, []string{"127.0.0.1"}, WithRefreshOnlyOnRequest(true),
+        WithNodeSubsetSize(1), WithClientID("client-1"), WithWarnOnSeedMismatch(true))
+    defer nodes.stop()
+    out := capture_stdout(t, func() { nodes.update() })
+    if a := nodes.current_nodes(); len(a) != 1 || a[0] == "127.0.0.1" {
+        t.Fatalf("subset is %v, expected one node other than the seed", a)
+    }
+    // The seed is one of the cluster's nodes, just not in our subset.
+    if strings.Contains(out, "WARNING") {
+        t.Errorf("unexpected warning: %s", out)
+    }
+    mismatched := NewAlternatorNodes("http", port, []string{"127.0.0.9"}, WithRefreshOnlyOnRequest(true),
+        WithNodeSubsetSize(1), WithWarnOnSeedMismatch(true))
+    defer mismatched.stop()
+    if out := capture_stdout(t, func() { mismatched.update() }); !strings.Contains(out, "WARNING: none of the known nodes") {
+        t.Errorf("no warning for seeds which aren't in the cluster: %s", out)
+    }
+}
@@ -17,7 +17,10 @@ func main() {
 
     // Use the local Alternator with our silly testing alternator/secret_pass
     // authentication - and the new load balancing code.
-    alternator_nodes := NewAlternatorNodes("http", 8000, []string {"127.0.0.1"})
+    // Log every request's node, to demonstrate that they go to different
+    // nodes.
+    alternator_nodes := NewAlternatorNodes("http", 8000, []string {"127.0.0.1"},
+        WithRewriteLogInterval(0))
     sess := alternator_nodes.session("dog.scylladb.com", "alternator", "secret_pass")
     db := dynamodb.New(sess)
 